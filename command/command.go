@@ -3,18 +3,33 @@ package command
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
 )
 
 const RemoteComponentName = "zug_ins_nirgendwo_2019"
 
+var logger = logging.New("command")
+
+// round-trip times and failures of commands, by command-name
+var (
+	commandLatency = metrics.NewHistogram("zug_command_duration_seconds",
+		"Round-trip time of commands sent to the player.", "cmd", metrics.LatencyBuckets)
+	commandFailures = metrics.NewCounter("zug_command_failures_total",
+		"Commands that could not be sent to the player.", "cmd")
+)
+
 // Command realizes a simple RPC interface
 type Command struct {
 	CommandID int           `json:"id"`
 	Command   string        `json:"cmd"`
 	Arguments []interface{} `json:"arg"`
+
+	// RequestID of the http-request, that issued the command
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func (cmd *Command) String() string {
@@ -31,6 +46,9 @@ type ACK struct {
 	Command *Command `json:"command"`
 	Success bool     `json:"success"`
 	Value   string   `json:"value"`
+
+	// RequestID is copied from the command
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // QueueWorker pulls commands from a channel, sends them via tcp
@@ -57,6 +75,9 @@ func (worker *QueueWorker) run() {
 	responseBuffer := make([]byte, 1<<11)
 
 	for cmd := range worker.Commands {
+		logger.Debug("send command", "cmd", cmd, "id", cmd.CommandID, "request_id", cmd.RequestID,
+			"queued", len(worker.Commands))
+
 		// send the command
 		ack := Send(cmd, worker.TCPAddress, responseBuffer)
 
@@ -72,7 +93,16 @@ func Send(cmd *Command, ip string, responseBuffer []byte) *ACK {
 	if responseBuffer == nil {
 		responseBuffer = make([]byte, 1<<11)
 	}
-	ack := &ACK{Command: cmd}
+	ack := &ACK{Command: cmd, RequestID: cmd.RequestID}
+	start := time.Now()
+
+	defer func() {
+		if ack.Success {
+			commandLatency.Observe(cmd.Command, time.Since(start).Seconds())
+		} else {
+			commandFailures.Inc(cmd.Command)
+		}
+	}()
 
 	// tcp communication with kinskiPlayer here
 	con, err := net.Dial("tcp", ip)
@@ -91,16 +121,15 @@ func Send(cmd *Command, ip string, responseBuffer []byte) *ACK {
 			timeOut := time.Now().Add(time.Millisecond * 200)
 
 			if deadLineErr := con.SetReadDeadline(timeOut); deadLineErr != nil {
-				log.Fatal(deadLineErr)
+				logger.Fatal("could not set read-deadline", "error", deadLineErr)
 			} else {
 
 				if bytesRead, readError := con.Read(responseBuffer); readError != nil {
-					// log.Println(readError)
-					// log.Println(cmd)
+					logger.Debug("no response", "cmd", cmd, "request_id", cmd.RequestID, "error", readError)
 				} else {
 					// we got a response here
 					response := string(responseBuffer[:bytesRead])
-					// log.Println(cmd, "->", response)
+					logger.Debug("response", "cmd", cmd, "request_id", cmd.RequestID, "value", response)
 					ack.Value = response
 				}
 			}
@@ -109,8 +138,47 @@ func Send(cmd *Command, ip string, responseBuffer []byte) *ACK {
 	return ack
 }
 
-// Playback sends the provided index and playlist to an attached media_player
-func Playback(ip string, index int, playlist []string, delays []float64) {
+// PlaybackItems groups the per-item properties of a playlist, sent to an attached media_player.
+// all slices share the order of Paths, nil slices are not sent
+type PlaybackItems struct {
+	Paths  []string
+	Delays []float64
+
+	// Durations are mandatory for still images, which have no intrinsic duration
+	Durations []float64
+
+	// Starts and Ends trim the items to a sub-clip, in seconds
+	Starts []float64
+	Ends   []float64
+
+	// audio/video settings
+	Volumes     []float64
+	Rates       []float64
+	AudioTracks []int
+	Aspects     []string
+	FadeIns     []float64
+	FadeOuts    []float64
+
+	// Transitions into the items, with their durations in seconds
+	Transitions         []string
+	TransitionDurations []float64
+
+	// Position to start the indexed item at, in seconds inside its movie. not sent if zero
+	Position float64
+
+	// RequestID of the http-request, that issued the playback. not sent, but copied to the ACK
+	RequestID string
+}
+
+// Playback sends the provided index and playlist-items to an attached media_player.
+// return: an ACK for the playback, successful if it was sent
+func Playback(ip string, index int, items *PlaybackItems) *ACK {
+	cmd := &Command{Command: "playback", Arguments: []interface{}{index}}
+
+	if items != nil {
+		cmd.RequestID = items.RequestID
+	}
+	ack := &ACK{Command: cmd, RequestID: cmd.RequestID}
 
 	type Property struct {
 		Name  string      `json:"name"`
@@ -125,20 +193,65 @@ func Playback(ip string, index int, playlist []string, delays []float64) {
 
 	comp := ComponentStruct{Name: RemoteComponentName}
 
-	if playlist != nil {
+	if items != nil && items.Paths != nil {
 		comp.Properties = append(comp.Properties, Property{
 			Name:  "playlist",
 			Type:  "string_array",
-			Value: playlist,
+			Value: items.Paths,
 		})
 	}
 
-	if delays != nil {
-		comp.Properties = append(comp.Properties, Property{
-			Name:  "delays",
-			Type:  "float_array",
-			Value: delays,
-		})
+	if items != nil {
+		floatArrays := []struct {
+			name   string
+			values []float64
+		}{
+			{"delays", items.Delays},
+			{"durations", items.Durations},
+			{"starts", items.Starts},
+			{"ends", items.Ends},
+			{"volumes", items.Volumes},
+			{"rates", items.Rates},
+			{"fade_ins", items.FadeIns},
+			{"fade_outs", items.FadeOuts},
+			{"transition_durations", items.TransitionDurations},
+		}
+
+		for _, array := range floatArrays {
+			if array.values != nil {
+				comp.Properties = append(comp.Properties, Property{
+					Name:  array.name,
+					Type:  "float_array",
+					Value: array.values,
+				})
+			}
+		}
+
+		if items.AudioTracks != nil {
+			comp.Properties = append(comp.Properties, Property{
+				Name:  "audio_tracks",
+				Type:  "int_array",
+				Value: items.AudioTracks,
+			})
+		}
+
+		stringArrays := []struct {
+			name   string
+			values []string
+		}{
+			{"aspects", items.Aspects},
+			{"transitions", items.Transitions},
+		}
+
+		for _, array := range stringArrays {
+			if array.values != nil {
+				comp.Properties = append(comp.Properties, Property{
+					Name:  array.name,
+					Type:  "string_array",
+					Value: array.values,
+				})
+			}
+		}
 	}
 
 	comp.Properties = append(comp.Properties, Property{
@@ -147,12 +260,20 @@ func Playback(ip string, index int, playlist []string, delays []float64) {
 		Value: index,
 	})
 
+	if items != nil && items.Position > 0 {
+		comp.Properties = append(comp.Properties, Property{
+			Name:  "playlist position",
+			Type:  "float",
+			Value: items.Position,
+		})
+	}
+
 	compList := []ComponentStruct{comp}
 
 	// serialize to json
 	if jsonBytes, jsonErr := json.Marshal(compList); jsonErr == nil {
 
-		// log.Println(string(jsonBytes))
+		logger.Debug("playback", "index", index, "request_id", cmd.RequestID, "json", string(jsonBytes))
 
 		// tcp communication with kinskiPlayer here
 		con, err := net.Dial("tcp", ip)
@@ -162,10 +283,15 @@ func Playback(ip string, index int, playlist []string, delays []float64) {
 
 			// send to player
 			if _, writeError := con.Write(jsonBytes); writeError != nil {
-				log.Println("could not send json data (Playback)")
+				logger.Error("could not send playback", "error", writeError)
+			} else {
+				ack.Success = true
 			}
+		} else {
+			logger.Warn("could not send playback, player not reachable", "address", ip, "error", err)
 		}
 	} else {
-		log.Println("could not marshal Playback struct to json")
+		logger.Error("could not marshal playback", "error", jsonErr)
 	}
+	return ack
 }
@@ -0,0 +1,17 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Load decodes a json-file into v, if present. v keeps its values, if the file can not be opened
+func Load(file string, v interface{}) error {
+	jsonFile, err := os.Open(file)
+
+	if err != nil {
+		return nil
+	}
+	defer jsonFile.Close()
+	return json.NewDecoder(jsonFile).Decode(v)
+}
@@ -0,0 +1,345 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+)
+
+// Level is the severity of a log-message
+type Level int32
+
+// log-levels, in ascending severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// output-formats
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Settings configures format and per-subsystem levels
+type Settings struct {
+	// Format is one of FormatLogfmt (default) or FormatJSON
+	Format string `json:"format"`
+
+	// Level is the default level of all subsystems
+	Level string `json:"level"`
+
+	// Levels overrides the level for single subsystems
+	Levels map[string]string `json:"levels"`
+}
+
+// Logger writes leveled, structured messages for a single subsystem
+type Logger struct {
+	subsystem string
+	level     int32
+}
+
+// settings holds the active logging-settings
+var settings = Settings{
+	Format: FormatLogfmt,
+	Level:  "info",
+	Levels: map[string]string{},
+}
+
+var settingsFile = "loggingSettings.json"
+
+// loggers by subsystem
+var loggers = make(map[string]*Logger)
+var loggersMutex sync.Mutex
+
+// output receives all messages, writes are serialized by outputMutex
+var output io.Writer = os.Stderr
+var outputMutex sync.Mutex
+
+// String returns the name of a level
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel returns the level with the provided name
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log-level: %s", name)
+}
+
+// LoadSettings reads the logging-settings from their json-file, if present,
+// and applies them to all subsystems. settings missing in the file keep their defaults
+func LoadSettings() Settings {
+	if err := jsonfile.Load(settingsFile, &settings); err != nil {
+		fmt.Fprintln(os.Stderr, "could not parse logging-settings:", err)
+	}
+
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	// "levels": null would clear the overrides
+	if settings.Levels == nil {
+		settings.Levels = map[string]string{}
+	}
+
+	for _, logger := range loggers {
+		atomic.StoreInt32(&logger.level, int32(levelFor(logger.subsystem)))
+	}
+	return settings
+}
+
+// levelFor returns the configured level of a subsystem. requires a locked loggersMutex
+func levelFor(subsystem string) Level {
+	name, ok := settings.Levels[subsystem]
+
+	if !ok {
+		name = settings.Level
+	}
+	level, _ := ParseLevel(name)
+	return level
+}
+
+// New returns the logger of a subsystem, creating it on first use
+func New(subsystem string) *Logger {
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	if logger, ok := loggers[subsystem]; ok {
+		return logger
+	}
+	logger := &Logger{subsystem: subsystem, level: int32(levelFor(subsystem))}
+	loggers[subsystem] = logger
+	return logger
+}
+
+// SetLevel changes the level of a subsystem at runtime, an empty subsystem changes all of them
+func SetLevel(subsystem string, name string) error {
+	level, err := ParseLevel(name)
+
+	if err != nil {
+		return err
+	}
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	if subsystem == "" {
+		settings.Level = level.String()
+		settings.Levels = map[string]string{}
+
+		for _, logger := range loggers {
+			atomic.StoreInt32(&logger.level, int32(level))
+		}
+		return nil
+	}
+	logger, ok := loggers[subsystem]
+
+	if !ok {
+		return fmt.Errorf("unknown subsystem: %s", subsystem)
+	}
+	settings.Levels[subsystem] = level.String()
+	atomic.StoreInt32(&logger.level, int32(level))
+	return nil
+}
+
+// Levels returns the current level of all subsystems
+func Levels() map[string]string {
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	levels := make(map[string]string, len(loggers))
+
+	for subsystem, logger := range loggers {
+		levels[subsystem] = Level(atomic.LoadInt32(&logger.level)).String()
+	}
+	return levels
+}
+
+// Enabled returns true, if messages of the provided level are written
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&logger.level))
+}
+
+// Debug writes a message with alternating keys and values
+func (logger *Logger) Debug(msg string, keyvals ...interface{}) {
+	logger.write(LevelDebug, msg, keyvals)
+}
+
+// Info writes a message with alternating keys and values
+func (logger *Logger) Info(msg string, keyvals ...interface{}) {
+	logger.write(LevelInfo, msg, keyvals)
+}
+
+// Warn writes a message with alternating keys and values
+func (logger *Logger) Warn(msg string, keyvals ...interface{}) {
+	logger.write(LevelWarn, msg, keyvals)
+}
+
+// Error writes a message with alternating keys and values
+func (logger *Logger) Error(msg string, keyvals ...interface{}) {
+	logger.write(LevelError, msg, keyvals)
+}
+
+// Fatal writes an error-message and exits the process
+func (logger *Logger) Fatal(msg string, keyvals ...interface{}) {
+	logger.write(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+// write formats and writes a message, if its level is enabled
+func (logger *Logger) write(level Level, msg string, keyvals []interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+	fields := []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"subsystem", logger.subsystem,
+		"msg", msg,
+	}
+	fields = append(fields, keyvals...)
+
+	// a missing value is logged as such
+	if len(fields)%2 != 0 {
+		fields = append(fields, "MISSING")
+	}
+	var line []byte
+
+	if settings.Format == FormatJSON {
+		line = formatJSON(fields)
+	} else {
+		line = formatLogfmt(fields)
+	}
+
+	outputMutex.Lock()
+	output.Write(line)
+	outputMutex.Unlock()
+}
+
+// valueString converts a value for output, errors and Stringers use their text
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// formatLogfmt formats key-value pairs as a single logfmt-line
+func formatLogfmt(fields []interface{}) []byte {
+	var builder strings.Builder
+
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		value := valueString(fields[i+1])
+
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		builder.WriteString(valueString(fields[i]))
+		builder.WriteByte('=')
+		builder.WriteString(value)
+	}
+	builder.WriteByte('\n')
+	return []byte(builder.String())
+}
+
+// formatJSON formats key-value pairs as a single json-object.
+// numbers and booleans keep their type, all other values are converted to strings
+func formatJSON(fields []interface{}) []byte {
+	keys := make([]string, 0, len(fields)/2)
+	values := make(map[string]interface{}, len(fields)/2)
+
+	for i := 0; i < len(fields); i += 2 {
+		key := valueString(fields[i])
+
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		switch v := fields[i+1].(type) {
+		case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+			values[key] = v
+		default:
+			values[key] = valueString(v)
+		}
+	}
+
+	// keep the order of the fields
+	var builder strings.Builder
+	builder.WriteByte('{')
+
+	for i, key := range keys {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		keyBytes, _ := json.Marshal(key)
+		valueBytes, err := json.Marshal(values[key])
+
+		if err != nil {
+			valueBytes, _ = json.Marshal(fmt.Sprint(values[key]))
+		}
+		builder.Write(keyBytes)
+		builder.WriteByte(':')
+		builder.Write(valueBytes)
+	}
+	builder.WriteString("}\n")
+	return []byte(builder.String())
+}
+
+// requestIDKey is the context-key of request-IDs
+type requestIDKey struct{}
+
+// NewRequestID returns a random request-ID
+func NewRequestID() string {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID returns a context carrying the provided request-ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request-ID of a context, or an empty string
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
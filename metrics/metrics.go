@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is implemented by all metric-types, writing themselves in the prometheus text-format
+type metric interface {
+	write(w io.Writer)
+}
+
+// registered metrics, in order of registration
+var registry []metric
+var registryMutex sync.Mutex
+
+// default buckets for durations in seconds
+var (
+	LatencyBuckets  = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	DurationBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// DroppedEvents counts events dropped by non-blocking sends, by queue
+var DroppedEvents = NewCounter("zug_events_dropped_total", "Events dropped because their queue was full.", "queue")
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, m)
+}
+
+// header writes the help- and type-lines of a metric
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels formats label-pairs, omitting pairs without name
+func labels(pairs ...string) string {
+	var parts []string
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] != "" {
+			parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat formats a value, using the prometheus notation for infinities
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map in ascending order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by a single label
+type Counter struct {
+	name, help, label string
+	values            map[string]float64
+	mutex             sync.Mutex
+}
+
+// NewCounter creates and registers a counter. label may be empty for counters without labels
+func NewCounter(name, help, label string) *Counter {
+	counter := &Counter{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(counter)
+	return counter
+}
+
+// Inc increments the counter for the provided label-value
+func (counter *Counter) Inc(labelValue string) {
+	counter.Add(labelValue, 1)
+}
+
+// Add increases the counter for the provided label-value
+func (counter *Counter) Add(labelValue string, value float64) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.values[labelValue] += value
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	header(w, counter.name, counter.help, "counter")
+
+	for _, key := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, labels(counter.label, key), formatFloat(counter.values[key]))
+	}
+}
+
+// GaugeFunc reports a value, computed at scrape-time
+type GaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge, calling value on every scrape
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{name: name, help: help, value: value}
+	register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) {
+	header(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatFloat(gauge.value()))
+}
+
+// histogramSeries holds the observations for a single label-value
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations in buckets, optionally partitioned by a single label
+type Histogram struct {
+	name, help, label string
+	buckets           []float64
+	series            map[string]*histogramSeries
+	mutex             sync.Mutex
+}
+
+// NewHistogram creates and registers a histogram with the provided upper bucket-bounds.
+// label may be empty for histograms without labels
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: append([]float64{}, buckets...),
+		series:  make(map[string]*histogramSeries),
+	}
+	sort.Float64s(histogram.buckets)
+	register(histogram)
+	return histogram
+}
+
+// Observe adds an observation for the provided label-value
+func (histogram *Histogram) Observe(labelValue string, value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	series, ok := histogram.series[labelValue]
+
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[labelValue] = series
+	}
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	header(w, histogram.name, histogram.help, "histogram")
+
+	keys := make([]string, 0, len(histogram.series))
+
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := histogram.series[key]
+
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name,
+				labels(histogram.label, key, "le", formatFloat(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, labels(histogram.label, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, labels(histogram.label, key), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, labels(histogram.label, key), series.count)
+	}
+}
+
+// Handler serves all registered metrics in the prometheus text-format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registryMutex.Lock()
+	metrics := append([]metric{}, registry...)
+	registryMutex.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux || darwin || freebsd
+
+package notify
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// diskMonitor periodically checks the free space of the filesystems holding the provided paths
+func diskMonitor(paths []string) {
+	ticker := time.NewTicker(time.Duration(settings.DiskInterval * float64(time.Second)))
+	defer ticker.Stop()
+
+	for {
+		for _, p := range paths {
+			checkDiskSpace(p)
+		}
+		<-ticker.C
+	}
+}
+
+// checkDiskSpace sends an alert, if the filesystem of path runs out of space
+func checkDiskSpace(path string) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil || stat.Blocks == 0 {
+		return
+	}
+	free := float64(stat.Bavail) / float64(stat.Blocks)
+
+	if free >= settings.DiskMinFree {
+		return
+	}
+	freeMB := uint64(stat.Bavail) * uint64(stat.Bsize) >> 20
+
+	Send(&Alert{
+		Event:    EventDiskSpace,
+		Severity: SeverityWarning,
+		Title:    "low disk space: " + path,
+		Message:  fmt.Sprintf("%d MB (%.1f%%) available", freeMB, free*100),
+		Data:     map[string]interface{}{"path": path, "free_mb": freeMB, "free": free},
+	})
+}
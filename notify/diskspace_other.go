@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package notify
+
+// diskMonitor is not supported on platforms without a common statfs
+func diskMonitor(paths []string) {
+	logger.Warn("disk-space checks are not supported on this platform")
+}
@@ -0,0 +1,412 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+)
+
+var logger = logging.New("notify")
+
+// events that trigger alerts
+const (
+	EventPlayerOffline     = "player_offline"
+	EventWatchdog          = "watchdog"
+	EventThumbnailFailed   = "thumbnail_failed"
+	EventLibraryChanged    = "library_changed"
+	EventDiskSpace         = "disk_space"
+	EventScheduleTriggered = "schedule_triggered"
+	EventTest              = "test"
+)
+
+// severities of alerts
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// formats of webhook-payloads
+const (
+	FormatSlack  = "slack"
+	FormatMatrix = "matrix"
+	FormatJSON   = "json"
+)
+
+// Alert is a structured notification, delivered to all configured targets
+type Alert struct {
+	Event    string      `json:"event"`
+	Severity string      `json:"severity"`
+	Title    string      `json:"title"`
+	Message  string      `json:"message"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+
+	// Suppressed counts alerts of the same kind, dropped by rate-limiting since the last delivery
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// Webhook posts alerts as json to an url
+type Webhook struct {
+	URL string `json:"url"`
+
+	// Format is one of FormatSlack (default), FormatMatrix or FormatJSON (the plain alert)
+	Format string `json:"format"`
+
+	// Events selects the events to deliver, empty for all
+	Events []string `json:"events"`
+}
+
+// SMTPSettings configures delivery of alerts via email
+type SMTPSettings struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	// Events selects the events to deliver, empty for all
+	Events []string `json:"events"`
+}
+
+// Settings configures the notification-targets, retries, rate-limiting and disk-space checks
+type Settings struct {
+	Webhooks []Webhook     `json:"webhooks"`
+	SMTP     *SMTPSettings `json:"smtp,omitempty"`
+
+	// Retries of failed deliveries, with an exponential backoff starting at RetryDelay seconds
+	Retries    int     `json:"retries"`
+	RetryDelay float64 `json:"retry_delay"`
+
+	// RateLimit is the minimum interval in seconds between alerts with the same event and title
+	RateLimit float64 `json:"rate_limit"`
+
+	// DiskPaths are checked every DiskInterval seconds,
+	// alerting if less than DiskMinFree (fraction of the total size) is available
+	DiskPaths    []string `json:"disk_paths"`
+	DiskMinFree  float64  `json:"disk_min_free"`
+	DiskInterval float64  `json:"disk_interval"`
+}
+
+// Result reports the delivery of an alert to a single target
+type Result struct {
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// settings holds the active notification-settings
+var settings = Settings{
+	Webhooks:     []Webhook{},
+	Retries:      3,
+	RetryDelay:   2,
+	RateLimit:    300,
+	DiskPaths:    []string{},
+	DiskMinFree:  0.05,
+	DiskInterval: 300,
+}
+
+var settingsFile = "notifySettings.json"
+
+// alerts waiting for delivery, processed by a single worker
+var queue = make(chan *Alert, 100)
+
+// time of the last delivery and number of suppressed alerts, by rate-limit key.
+// keys are pruned once their rate-limit expired
+var lastSent = make(map[string]time.Time)
+var suppressed = make(map[string]int)
+var lastPruned time.Time
+var rateMutex sync.Mutex
+
+// testTimeout limits the delivery of test-alerts, including retries
+var testTimeout = 15 * time.Second
+
+// LoadSettings reads the notification-settings from their json-file, if present.
+// settings missing in the file keep their defaults
+func LoadSettings() Settings {
+	if err := jsonfile.Load(settingsFile, &settings); err != nil {
+		logger.Error("could not parse notification-settings", "error", err)
+	}
+	return settings
+}
+
+// Start runs the delivery-worker and the disk-space checks.
+// extraDiskPaths are checked in addition to the configured paths
+func Start(extraDiskPaths ...string) {
+	go worker()
+
+	paths := append(append([]string{}, settings.DiskPaths...), extraDiskPaths...)
+
+	if len(paths) > 0 && settings.DiskInterval > 0 {
+		go diskMonitor(paths)
+	}
+}
+
+// Send enqueues an alert for delivery, never blocks.
+// alerts are dropped if no target is configured, the queue is full or they exceed the rate-limit
+func Send(alert *Alert) {
+	if len(settings.Webhooks) == 0 && settings.SMTP == nil {
+		return
+	}
+
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+
+	if !allow(alert) {
+		return
+	}
+
+	select {
+	case queue <- alert:
+	default:
+		metrics.DroppedEvents.Inc("alert")
+		logger.Warn("notification-queue full, dropped alert", "event", alert.Event, "title", alert.Title)
+	}
+}
+
+// ScheduleTriggered alerts that a scheduled action was triggered, e.g. a playlist started at a configured time.
+// this is the hook for schedulers, data describes the triggering schedule-entry
+func ScheduleTriggered(name, action string, data interface{}) {
+	Send(&Alert{
+		Event:    EventScheduleTriggered,
+		Severity: SeverityInfo,
+		Title:    "schedule triggered: " + name,
+		Message:  action,
+		Data:     data,
+	})
+}
+
+// Test delivers a test-alert to all targets in parallel, bypassing event-filters and rate-limiting.
+// targets still retrying after the testTimeout are reported as timed out
+func Test() []Result {
+	alert := &Alert{
+		Event:    EventTest,
+		Severity: SeverityInfo,
+		Title:    "test notification",
+		Message:  "notifications are working",
+		Time:     time.Now(),
+	}
+	targets := deliveries(alert, true)
+	results := make([]Result, len(targets))
+	done := make(chan int, len(targets))
+	finished := make([]Result, len(targets))
+
+	for i, target := range targets {
+		results[i] = Result{Target: target.name, Error: "timed out"}
+
+		go func(i int, target delivery) {
+			finished[i] = retry(target.name, target.send)
+			done <- i
+		}(i, target)
+	}
+	timeout := time.After(testTimeout)
+
+	for range targets {
+		select {
+		case i := <-done:
+			results[i] = finished[i]
+		case <-timeout:
+			return results
+		}
+	}
+	return results
+}
+
+// allow applies the rate-limit and attaches the number of previously suppressed alerts
+func allow(alert *Alert) bool {
+	key := alert.Event + "\n" + alert.Title
+
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+
+	limit := time.Duration(settings.RateLimit * float64(time.Second))
+
+	if last, ok := lastSent[key]; ok && alert.Time.Sub(last) < limit {
+		suppressed[key]++
+		return false
+	}
+	lastSent[key] = alert.Time
+	alert.Suppressed = suppressed[key]
+	delete(suppressed, key)
+
+	// drop keys with an expired rate-limit, at most once per interval
+	if alert.Time.Sub(lastPruned) >= limit {
+		for k, last := range lastSent {
+			if alert.Time.Sub(last) >= limit {
+				delete(lastSent, k)
+				delete(suppressed, k)
+			}
+		}
+		lastPruned = alert.Time
+	}
+	return true
+}
+
+func worker() {
+	for alert := range queue {
+		for _, result := range deliver(alert, false) {
+			if result.Error != "" {
+				logger.Error("could not deliver alert", "target", result.Target, "event", alert.Event,
+					"error", result.Error)
+			} else {
+				logger.Debug("alert delivered", "target", result.Target, "event", alert.Event, "title", alert.Title)
+			}
+		}
+	}
+}
+
+// delivery sends an alert to a single target
+type delivery struct {
+	name string
+	send func() error
+}
+
+// deliveries returns the deliveries of an alert to all targets, that selected its event
+func deliveries(alert *Alert, all bool) []delivery {
+	targets := []delivery{}
+
+	for _, hook := range settings.Webhooks {
+		if all || selects(hook.Events, alert.Event) {
+			hook := hook
+			targets = append(targets, delivery{hook.URL, func() error { return hook.post(alert) }})
+		}
+	}
+
+	if smtpSettings := settings.SMTP; smtpSettings != nil && (all || selects(smtpSettings.Events, alert.Event)) {
+		targets = append(targets, delivery{"smtp://" + smtpSettings.Host, func() error { return smtpSettings.send(alert) }})
+	}
+	return targets
+}
+
+// deliver sends an alert to all targets, that selected its event, retrying failed deliveries
+func deliver(alert *Alert, all bool) []Result {
+	results := []Result{}
+
+	for _, target := range deliveries(alert, all) {
+		results = append(results, retry(target.name, target.send))
+	}
+	return results
+}
+
+// selects returns true, if an event is part of the provided events or events is empty
+func selects(events []string, event string) bool {
+	if len(events) == 0 || event == EventTest {
+		return true
+	}
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs a delivery until it succeeds or all retries are used
+func retry(target string, delivery func() error) Result {
+	delay := time.Duration(settings.RetryDelay * float64(time.Second))
+	err := delivery()
+
+	for i := 0; err != nil && i < settings.Retries; i++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = delivery()
+	}
+	result := Result{Target: target}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// text formats an alert as a single message
+func (alert *Alert) text() string {
+	text := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.Severity), alert.Title)
+
+	if alert.Message != "" {
+		text += ": " + alert.Message
+	}
+
+	if alert.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d similar alerts suppressed)", alert.Suppressed)
+	}
+	return text
+}
+
+// post sends an alert to a webhook, in the webhook's format
+func (hook *Webhook) post(alert *Alert) error {
+	var payload interface{}
+
+	switch hook.Format {
+	case FormatJSON:
+		payload = alert
+	case FormatMatrix:
+		payload = map[string]string{"text": alert.text(), "body": alert.text(), "msgtype": "m.notice"}
+	default:
+		payload = map[string]string{"text": alert.text()}
+	}
+	jsonBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(jsonBytes))
+
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// headerText replaces line-breaks and other control-characters, e.g. inside file-paths,
+// which would inject headers into an email
+func headerText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// send delivers an alert as email
+func (smtpSettings *SMTPSettings) send(alert *Alert) error {
+	addr := fmt.Sprintf("%s:%d", smtpSettings.Host, smtpSettings.Port)
+	var auth smtp.Auth
+
+	if smtpSettings.Username != "" {
+		auth = smtp.PlainAuth("", smtpSettings.Username, smtpSettings.Password, smtpSettings.Host)
+	}
+	body := alert.text() + "\n\ntime: " + alert.Time.Format(time.RFC3339) + "\n"
+
+	if alert.Data != nil {
+		if jsonBytes, err := json.MarshalIndent(alert.Data, "", "  "); err == nil {
+			body += "\n" + string(jsonBytes) + "\n"
+		}
+	}
+	msg := "From: " + smtpSettings.From + "\r\n" +
+		"To: " + strings.Join(smtpSettings.To, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerText(alert.text())) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + body
+
+	return smtp.SendMail(addr, auth, smtpSettings.From, smtpSettings.To, []byte(msg))
+}
@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	defer func(rateLimit float64) { settings.RateLimit = rateLimit }(settings.RateLimit)
+	settings.RateLimit = 60
+
+	lastSent = make(map[string]time.Time)
+	suppressed = make(map[string]int)
+	lastPruned = time.Time{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		title      string
+		seconds    int
+		allowed    bool
+		suppressed int
+	}{
+		{"a", 0, true, 0},
+		{"a", 10, false, 0},
+		{"a", 20, false, 0},
+		{"b", 30, true, 0},
+		{"a", 61, true, 2},
+		{"a", 100, false, 0},
+		{"a", 130, true, 1},
+	}
+
+	for _, test := range tests {
+		alert := &Alert{Event: EventWatchdog, Title: test.title, Time: start.Add(time.Duration(test.seconds) * time.Second)}
+
+		if allowed := allow(alert); allowed != test.allowed || alert.Suppressed != test.suppressed {
+			t.Errorf("%s at %ds: got %v with %d suppressed, want %v with %d suppressed",
+				test.title, test.seconds, allowed, alert.Suppressed, test.allowed, test.suppressed)
+		}
+	}
+
+	// "b" expired and was pruned
+	if len(lastSent) != 1 || len(suppressed) != 0 {
+		t.Errorf("not pruned: %v, %v", lastSent, suppressed)
+	}
+}
@@ -0,0 +1,123 @@
+package playlist
+
+import (
+	"fmt"
+)
+
+// aspect-modes, used to fit a movie to the screen
+const (
+	AspectFit      = "fit"
+	AspectFill     = "fill"
+	AspectStretch  = "stretch"
+	AspectOriginal = "original"
+)
+
+// AVSettings groups the audio/video settings of a movie, sent with playback
+type AVSettings struct {
+	Volume float64 `json:"volume"`
+	Rate   float64 `json:"rate"`
+
+	// AudioTrack selects an audio-stream, as index into the movie's audio-tracks
+	AudioTrack int `json:"audio_track"`
+
+	// Aspect is one of AspectFit, AspectFill (crop), AspectStretch or AspectOriginal
+	Aspect string `json:"aspect"`
+
+	// FadeIn and FadeOut durations in seconds
+	FadeIn  float64 `json:"fade_in"`
+	FadeOut float64 `json:"fade_out"`
+}
+
+// defaultAVSettings are used for movies without own settings
+var defaultAVSettings = AVSettings{
+	Volume: 1,
+	Rate:   1,
+	Aspect: AspectFit,
+}
+
+// av returns the movie's audio/video settings or the defaults, if not set
+func (mov *Movie) av() AVSettings {
+	if mov.AV == nil {
+		return defaultAVSettings
+	}
+	return *mov.AV
+}
+
+// validate checks the settings for consistency, audio-tracks are checked against the movie's metadata
+func (settings *AVSettings) validate(mov *Movie) error {
+	switch {
+	case settings.Volume < 0:
+		return fmt.Errorf("invalid volume: %.3f", settings.Volume)
+	case settings.Rate <= 0:
+		return fmt.Errorf("invalid rate: %.3f", settings.Rate)
+	case settings.FadeIn < 0 || settings.FadeOut < 0:
+		return fmt.Errorf("invalid fades: %.3f / %.3f", settings.FadeIn, settings.FadeOut)
+	case settings.AudioTrack < 0 ||
+		(mov.Info != nil && settings.AudioTrack > 0 && settings.AudioTrack >= len(mov.Info.AudioTracks)):
+		return fmt.Errorf("invalid audio-track: %d", settings.AudioTrack)
+	}
+
+	switch settings.Aspect {
+	case AspectFit, AspectFill, AspectStretch, AspectOriginal:
+	default:
+		return fmt.Errorf("unknown aspect-mode: %s", settings.Aspect)
+	}
+	return nil
+}
+
+// apply changes the movie's settings, rejecting invalid values.
+// delay, volume and rate are only changed, if defaults is true,
+// otherwise they were meant for a playlist-entry. requires a locked movieMutex
+func (mov *Movie) apply(settings *MovieSettings, defaults bool) error {
+	av := mov.av()
+	delay := mov.Delay
+
+	if defaults {
+		if settings.Delay != nil {
+			delay = *settings.Delay
+		}
+
+		if settings.Volume != nil {
+			av.Volume = *settings.Volume
+		}
+
+		if settings.Rate != nil {
+			av.Rate = *settings.Rate
+		}
+	}
+
+	if settings.AudioTrack != nil {
+		av.AudioTrack = *settings.AudioTrack
+	}
+
+	if settings.Aspect != nil {
+		av.Aspect = *settings.Aspect
+	}
+
+	if settings.FadeIn != nil {
+		av.FadeIn = *settings.FadeIn
+	}
+
+	if settings.FadeOut != nil {
+		av.FadeOut = *settings.FadeOut
+	}
+
+	if delay < 0 {
+		return fmt.Errorf("invalid delay: %.3f", delay)
+	}
+
+	if err := av.validate(mov); err != nil {
+		return err
+	}
+	mov.Delay = delay
+
+	if mov.AV != nil || av != defaultAVSettings {
+		mov.AV = &av
+	}
+
+	// still images have no intrinsic duration
+	if mov.Type == MediaTypeImage && settings.Duration != nil && *settings.Duration > 0 {
+		mov.Duration = *settings.Duration
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package playlist
+
+import (
+	"fmt"
+	"math"
+)
+
+// PlaylistEntry is a single item of a playlist, referencing a movie of the library.
+// entries hold their own playback-settings, so a movie can appear in several playlists,
+// or several times in one playlist, with different settings
+type PlaylistEntry struct {
+	*Movie
+
+	// Delay after each play of the entry in seconds, shadows the movie's default delay
+	Delay float64 `json:"delay"`
+
+	// In and Out trim the movie in seconds, an Out of zero plays until the end
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+
+	// Volume and Rate override the movie's defaults, if set
+	Volume *float64 `json:"volume,omitempty"`
+	Rate   *float64 `json:"rate,omitempty"`
+
+	// Loops repeats the entry, before the next one starts
+	Loops int `json:"loops,omitempty"`
+
+	// Transition into this entry, overrides the playlist's transition
+	Transition *Transition `json:"transition,omitempty"`
+}
+
+// MovieSettings changes the default settings of a movie or the settings of a single playlist-entry.
+// nil-values are left unchanged
+type MovieSettings struct {
+	Path string `json:"path"`
+
+	// PlaylistIndex and EntryIndex select an entry of a manual playlist,
+	// otherwise the movie's defaults are changed
+	PlaylistIndex *int `json:"playlist_index"`
+	EntryIndex    *int `json:"entry_index"`
+
+	Delay *float64 `json:"delay"`
+
+	// Duration is the display-duration of still images, which is a movie-setting only
+	Duration *float64 `json:"duration"`
+
+	In         *float64    `json:"in"`
+	Out        *float64    `json:"out"`
+	Volume     *float64    `json:"volume"`
+	Rate       *float64    `json:"rate"`
+	Loops      *int        `json:"loops"`
+	Transition *Transition `json:"transition"`
+
+	// movie-settings, also applied to the movie if an entry is selected
+	AudioTrack *int     `json:"audio_track"`
+	Aspect     *string  `json:"aspect"`
+	FadeIn     *float64 `json:"fade_in"`
+	FadeOut    *float64 `json:"fade_out"`
+}
+
+// newEntry creates a playlist-entry for a movie, using the movie's default settings
+func newEntry(mov *Movie) *PlaylistEntry {
+	return &PlaylistEntry{Movie: mov, Delay: mov.Delay}
+}
+
+// newEntries creates playlist-entries for all provided movies
+func newEntries(movies []*Movie) []*PlaylistEntry {
+	entries := make([]*PlaylistEntry, len(movies))
+
+	for i, mov := range movies {
+		entries[i] = newEntry(mov)
+	}
+	return entries
+}
+
+// loops returns the number of consecutive plays of the entry
+func (entry *PlaylistEntry) loops() int {
+	if entry.Loops < 1 {
+		return 1
+	}
+	return entry.Loops
+}
+
+// trim returns start and end of the entry inside its movie, for a movie of the provided duration.
+// if duration is zero, the movie's known duration is used. still images are never trimmed
+func (entry *PlaylistEntry) trim(duration float64) (float64, float64) {
+	if duration <= 0 {
+		duration = entry.Duration
+	}
+
+	if entry.Type == MediaTypeImage {
+		return 0, duration
+	}
+	start, end := entry.In, duration
+
+	if entry.Out > 0 && (end <= 0 || entry.Out < end) {
+		end = entry.Out
+	}
+
+	if end > 0 && start > end {
+		start = end
+	}
+	return start, end
+}
+
+// playDuration returns the duration of a single play of the trimmed entry
+func (entry *PlaylistEntry) playDuration() float64 {
+	start, end := entry.trim(0)
+	return math.Max(end-start, 0)
+}
+
+// volume returns the entry's volume, defaults to the movie's volume
+func (entry *PlaylistEntry) volume() float64 {
+	if entry.Volume != nil {
+		return *entry.Volume
+	}
+	return entry.av().Volume
+}
+
+// rate returns the entry's playback-rate, defaults to the movie's rate
+func (entry *PlaylistEntry) rate() float64 {
+	if entry.Rate != nil {
+		return *entry.Rate
+	}
+	return entry.av().Rate
+}
+
+// itemRuntime returns the time a single play of the entry occupies, including its delay.
+// the delay is not affected by the playback-rate
+func (entry *PlaylistEntry) itemRuntime() float64 {
+	return entry.playDuration()/entry.rate() + entry.Delay
+}
+
+// runtime returns the time an entry occupies in a playlist, including all loops and delays
+func (entry *PlaylistEntry) runtime() float64 {
+	return entry.itemRuntime() * float64(entry.loops())
+}
+
+// apply changes the entry's settings, rejecting invalid values
+func (entry *PlaylistEntry) apply(settings *MovieSettings) error {
+	changed := *entry
+
+	if settings.Delay != nil {
+		changed.Delay = *settings.Delay
+	}
+
+	if settings.In != nil {
+		changed.In = *settings.In
+	}
+
+	if settings.Out != nil {
+		changed.Out = *settings.Out
+	}
+
+	if settings.Volume != nil {
+		changed.Volume = settings.Volume
+	}
+
+	if settings.Rate != nil {
+		changed.Rate = settings.Rate
+	}
+
+	if settings.Loops != nil {
+		changed.Loops = *settings.Loops
+	}
+
+	// an empty transition-type resets to the playlist's transition
+	if settings.Transition != nil {
+		changed.Transition = settings.Transition
+
+		if settings.Transition.Type == "" {
+			changed.Transition = nil
+		}
+	}
+
+	if err := changed.validate(); err != nil {
+		return err
+	}
+	*entry = changed
+	return nil
+}
+
+// validate checks the entry's settings for consistency
+func (entry *PlaylistEntry) validate() error {
+	switch {
+	case entry.Delay < 0:
+		return fmt.Errorf("invalid delay: %.3f", entry.Delay)
+	case entry.In < 0 || entry.Out < 0 || (entry.Out > 0 && entry.Out <= entry.In):
+		return fmt.Errorf("invalid in/out points: %.3f - %.3f", entry.In, entry.Out)
+	case entry.Volume != nil && *entry.Volume < 0:
+		return fmt.Errorf("invalid volume: %.3f", *entry.Volume)
+	case entry.Rate != nil && *entry.Rate <= 0:
+		return fmt.Errorf("invalid rate: %.3f", *entry.Rate)
+	case entry.Loops < 0:
+		return fmt.Errorf("invalid loop-count: %d", entry.Loops)
+	case entry.Transition != nil:
+		return entry.Transition.validate()
+	}
+	return nil
+}
+
+// UpdateMovieSettings changes the settings of a single entry of a manual playlist,
+// or the default settings of a movie. entries of library- and smart-playlists follow their movie's defaults.
+// movie-only settings are applied to the entry's movie
+func UpdateMovieSettings(settings *MovieSettings) error {
+	forEntry := settings.PlaylistIndex != nil && settings.EntryIndex != nil
+
+	if forEntry {
+		if err := updateEntrySettings(settings); err != nil {
+			return err
+		}
+	}
+	movieMutex.Lock()
+	defer movieMutex.Unlock()
+
+	mov, ok := movieMap[settings.Path]
+
+	if !ok {
+		return fmt.Errorf("unknown movie: %s", settings.Path)
+	}
+
+	if err := mov.apply(settings, !forEntry); err != nil {
+		return err
+	}
+
+	// library- and smart-playlists use the changed defaults
+	playlistMutex.Lock()
+	rebuildLibraryPlaylists()
+	playlistMutex.Unlock()
+	return nil
+}
+
+// updateEntrySettings applies the settings to the selected entry of a manual playlist
+func updateEntrySettings(settings *MovieSettings) error {
+	playlistMutex.Lock()
+	defer playlistMutex.Unlock()
+
+	playlistIndex, entryIndex := *settings.PlaylistIndex, *settings.EntryIndex
+
+	if playlistIndex < 0 || playlistIndex >= len(playlists) {
+		return fmt.Errorf("playlist-index out of range: %d", playlistIndex)
+	}
+	list := playlists[playlistIndex]
+
+	if list.Type != PlaylistTypeManual {
+		return fmt.Errorf("entries of %s-playlists use their movie's settings", list.Type)
+	}
+
+	if entryIndex < 0 || entryIndex >= len(list.Movies) {
+		return fmt.Errorf("entry-index out of range: %d", entryIndex)
+	}
+	entry := list.Movies[entryIndex]
+
+	// reject stale indices
+	if settings.Path == "" {
+		settings.Path = entry.Path
+	} else if settings.Path != entry.Path {
+		return fmt.Errorf("entry %d of '%s' is not %s", entryIndex, list.Title, settings.Path)
+	}
+	return entry.apply(settings)
+}
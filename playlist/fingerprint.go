@@ -0,0 +1,233 @@
+package playlist
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+)
+
+// fingerprintChunkSize is the size of each chunk sampled for a fingerprint
+const fingerprintChunkSize = 1 << 16
+
+// fingerprintNumChunks is the number of chunks, evenly spread across a file
+const fingerprintNumChunks = 8
+
+// Fingerprint creates a content-hash for the provided file,
+// using its size and a number of sampled chunks
+func Fingerprint(path string) (string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	hash := sha1.New()
+	binary.Write(hash, binary.LittleEndian, size)
+
+	buf := make([]byte, fingerprintChunkSize)
+
+	for i := 0; i < fingerprintNumChunks; i++ {
+		var offset int64
+
+		if size > fingerprintChunkSize {
+			offset = (size - fingerprintChunkSize) * int64(i) / (fingerprintNumChunks - 1)
+		}
+		bytesRead, readErr := file.ReadAt(buf, offset)
+
+		if readErr != nil && readErr != io.EOF {
+			return "", readErr
+		}
+		hash.Write(buf[:bytesRead])
+
+		// small files are covered by a single chunk
+		if size <= fingerprintChunkSize {
+			break
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// reassociateMoved matches fingerprints of new movie-paths against missing movies
+// and moves matching records, including their icon, to the new path.
+// requires a locked movieMutex.
+// return: a map of old paths to new paths
+func reassociateMoved(fingerprints map[string]string) map[string]string {
+	renamed := make(map[string]string)
+
+	if len(fingerprints) == 0 {
+		return renamed
+	}
+	missing := make(map[string]*Movie)
+
+	for _, mov := range movieMap {
+		if mov.Missing && mov.Fingerprint != "" {
+			missing[mov.Fingerprint] = mov
+		}
+	}
+
+	for newPath, fp := range fingerprints {
+		mov, ok := missing[fp]
+
+		if !ok {
+			continue
+		}
+
+		if _, taken := movieMap[newPath]; taken {
+			continue
+		}
+		oldPath := mov.Path
+		delete(movieMap, oldPath)
+		delete(missing, fp)
+		mov.Path = newPath
+		mov.Missing = false
+		movieMap[newPath] = mov
+		renamed[oldPath] = newPath
+	}
+	moveIcons(renamed)
+
+	if len(renamed) > 0 {
+		logger.Info("re-associated moved movies", "movies", len(renamed))
+	}
+	return renamed
+}
+
+// moveIcons re-keys the IconMap for all provided old -> new paths
+func moveIcons(renamed map[string]string) {
+	thumbMutex.Lock()
+	defer thumbMutex.Unlock()
+
+	for oldPath, newPath := range renamed {
+		if icon, ok := IconMap[oldPath]; ok {
+			IconMap[newPath] = icon
+			delete(IconMap, oldPath)
+		}
+	}
+}
+
+// RelocateRoot moves the media-root located at oldRoot to newRoot, e.g. after its mount point changed.
+// the paths of all movies below oldRoot are rewritten to the same relative location below newRoot
+// and the media-roots are saved. movies are never merged with existing records at their new path,
+// such conflicts abort the relocation without any changes.
+// return: a map of old paths to new paths
+func RelocateRoot(oldRoot, newRoot string) (map[string]string, error) {
+	oldRoot = filepath.Clean(oldRoot)
+	newRoot = filepath.Clean(newRoot)
+
+	if info, err := os.Stat(newRoot); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: no directory at %s", os.ErrNotExist, newRoot)
+	}
+	relocated := make(map[string]string)
+
+	movieMutex.Lock()
+	roots := getMediaRoots()
+	rootIndex := -1
+
+	for i, root := range roots {
+		if root.Path == oldRoot {
+			rootIndex = i
+		} else if root.Path == newRoot {
+			movieMutex.Unlock()
+			return nil, fmt.Errorf("media-root '%s' exists at %s", root.Name, newRoot)
+		}
+	}
+
+	if rootIndex < 0 {
+		movieMutex.Unlock()
+		return nil, fmt.Errorf("%w: no media-root at %s", os.ErrNotExist, oldRoot)
+	}
+
+	for p := range movieMap {
+		rel, err := filepath.Rel(oldRoot, p)
+
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			relocated[p] = filepath.Join(newRoot, rel)
+		}
+	}
+
+	// refuse to replace records, which are not relocated themselves
+	for _, newPath := range relocated {
+		if _, taken := movieMap[newPath]; taken {
+			if _, moving := relocated[newPath]; !moving {
+				movieMutex.Unlock()
+				return nil, fmt.Errorf("movie exists at %s", newPath)
+			}
+		}
+	}
+	newMap := make(map[string]*Movie, len(movieMap))
+	var moved []*Movie
+
+	for p, mov := range movieMap {
+		if newPath, ok := relocated[p]; ok {
+			mov.Path = newPath
+			newMap[newPath] = mov
+			moved = append(moved, mov)
+		} else {
+			newMap[p] = mov
+		}
+	}
+	movieMap = newMap
+
+	// replace the root, its playlist keeps its index
+	root := *roots[rootIndex]
+	root.Path = newRoot
+	roots[rootIndex] = &root
+	rootsMutex.Lock()
+	mediaRoots = roots
+	rootsMutex.Unlock()
+
+	// availability might have changed
+	for _, mov := range moved {
+		_, err := os.Stat(mov.Path)
+		mov.Missing = err != nil
+	}
+
+	// swap all playlist-items for their relocated records
+	playlistMutex.Lock()
+	for _, list := range playlists[numLibraryPlaylists():] {
+		for _, entry := range list.Movies {
+			if movPtr, ok := movieMap[entry.Path]; ok {
+				entry.Movie = movPtr
+			}
+		}
+	}
+	rebuildLibraryPlaylists()
+	playlistMutex.Unlock()
+	movieMutex.Unlock()
+
+	moveIcons(relocated)
+	logger.Info("relocated media-root", "root", root.Name, "from", oldRoot, "to", newRoot,
+		"movies", len(relocated))
+
+	if err := saveMediaRoots(); err != nil {
+		logger.Error("could not save media-roots", "error", err)
+	}
+
+	if len(relocated) > 0 {
+		saveIconMap()
+
+		// notify listeners, never block
+		change := &LibraryChange{Renamed: relocated}
+
+		select {
+		case LibraryEvents <- change:
+		default:
+			metrics.DroppedEvents.Inc("library")
+		}
+		alertLibraryChange(change)
+	}
+	return relocated, nil
+}
@@ -0,0 +1,282 @@
+package playlist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+)
+
+// ThumbnailSettings configures thumbnail generation
+type ThumbnailSettings struct {
+	// Sizes maps size-names to thumbnail-widths in pixels, 0 keeps the original width
+	Sizes map[string]int `json:"sizes"`
+
+	// IconSize is the size used as movie-icon
+	IconSize string `json:"icon_size"`
+
+	// FrameTime selects the thumbnail-frame in seconds, FramePercent relative to the duration.
+	// if both are zero, the frame is chosen automatically
+	FrameTime    float64 `json:"frame_time"`
+	FramePercent float64 `json:"frame_percent"`
+
+	Sprite SpriteSettings `json:"sprite"`
+}
+
+// SpriteSettings configures the sprite-sheets used for scrub-previews
+type SpriteSettings struct {
+	Enabled   bool `json:"enabled"`
+	Columns   int  `json:"columns"`
+	Rows      int  `json:"rows"`
+	TileWidth int  `json:"tile_width"`
+}
+
+// SpriteSheet describes a grid of frames, evenly spread across a movie
+type SpriteSheet struct {
+	Image      string  `json:"image"`
+	VTT        string  `json:"vtt"`
+	Index      string  `json:"index"`
+	TileWidth  int     `json:"tile_width"`
+	TileHeight int     `json:"tile_height"`
+	Columns    int     `json:"columns"`
+	Rows       int     `json:"rows"`
+	Interval   float64 `json:"interval"`
+}
+
+// SpriteFrame locates a single frame inside a sprite-sheet
+type SpriteFrame struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	X     int     `json:"x"`
+	Y     int     `json:"y"`
+}
+
+// thumbSettings holds the active thumbnail-settings
+var thumbSettings = ThumbnailSettings{
+	Sizes:    map[string]int{"small": 320, "large": 1280},
+	IconSize: "small",
+	Sprite:   SpriteSettings{Enabled: true, Columns: 10, Rows: 10, TileWidth: 160},
+}
+
+var thumbSettingsFile = "thumbnailSettings.json"
+
+// FFMpegPath is the ffmpeg executable used to extract frames at specific times
+var FFMpegPath = "ffmpeg"
+
+// LoadThumbnailSettings reads the thumbnail-settings from their json-file, if present.
+// settings missing in the file keep their defaults
+func LoadThumbnailSettings() ThumbnailSettings {
+	if err := jsonfile.Load(thumbSettingsFile, &thumbSettings); err != nil {
+		logger.Error("could not parse thumbnail-settings", "error", err)
+	}
+	return thumbSettings
+}
+
+// thumbRelPath returns the served path of a thumbnail-file for a movie.
+// the icon-size is named '<key>.jpg', all other files '<key>_<suffix>'
+func thumbRelPath(mov *Movie, suffix string) string {
+	return versionedThumbRelPath(mov, "", suffix)
+}
+
+// versionedThumbRelPath returns the served path of a thumbnail-file with a version appended to the key,
+// i.e. '<key>-<version>.jpg', so browsers do not show a cached former thumbnail
+func versionedThumbRelPath(mov *Movie, version, suffix string) string {
+	key := thumbKey(mov)
+
+	if version != "" {
+		key += "-" + version
+	}
+
+	if suffix == thumbSettings.IconSize+".jpg" {
+		return filepath.Join(thumbsDirRel, key+".jpg")
+	}
+	return filepath.Join(thumbsDirRel, key+"_"+suffix)
+}
+
+// writeThumbnailSizes writes all configured sizes of a frame as thumbnails for a movie.
+// if the icon-size is not configured, the unscaled frame is used as icon.
+// a non-empty version is added to the file-names, see versionedThumbRelPath.
+// return: the icon-path and the paths of all sizes
+func writeThumbnailSizes(mov *Movie, frame image.Image, outDir, version string) (string, map[string]string, error) {
+	thumbs := make(map[string]string)
+
+	for name, width := range thumbSettings.Sizes {
+		imgRelPath := versionedThumbRelPath(mov, version, name+".jpg")
+
+		if err := writeJPEG(filepath.Join(outDir, imgRelPath), scaleToWidth(frame, width)); err != nil {
+			return "", nil, err
+		}
+		thumbs[name] = imgRelPath
+	}
+	iconPath, hasIconSize := thumbs[thumbSettings.IconSize]
+
+	// keep the original frame as icon
+	if !hasIconSize {
+		iconPath = versionedThumbRelPath(mov, version, thumbSettings.IconSize+".jpg")
+
+		if err := writeJPEG(filepath.Join(outDir, iconPath), frame); err != nil {
+			return "", nil, err
+		}
+	}
+	return iconPath, thumbs, nil
+}
+
+// frameTime returns the configured thumbnail-time for a movie of the provided duration,
+// or zero if the frame is chosen automatically
+func frameTime(duration float64) float64 {
+	if thumbSettings.FrameTime > 0 {
+		return math.Min(thumbSettings.FrameTime, duration)
+	}
+	return duration * thumbSettings.FramePercent / 100
+}
+
+// extractFrame decodes a single frame at the provided time using ffmpeg
+func extractFrame(ctx context.Context, path string, seconds float64) (image.Image, error) {
+	out, err := exec.CommandContext(ctx, FFMpegPath, "-v", "error",
+		"-ss", fmt.Sprintf("%.3f", seconds), "-i", path,
+		"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-").Output()
+
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+// scaleToWidth downscales an image to the provided width, keeping its aspect-ratio.
+// uses an area-average filter, images are never upscaled
+func scaleToWidth(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+
+	if width <= 0 || width >= bounds.Dx() {
+		return src
+	}
+	height := int(math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx())))
+
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, a, n uint64
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset+0] = uint8(r / n >> 8)
+			dst.Pix[offset+1] = uint8(g / n >> 8)
+			dst.Pix[offset+2] = uint8(b / n >> 8)
+			dst.Pix[offset+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// writeJPEG encodes an image as jpeg-file
+func writeJPEG(path string, img image.Image) error {
+	imgFile, err := os.Create(path)
+
+	if err != nil {
+		logger.Warn("could not create file", "path", path, "error", err)
+		return err
+	}
+	defer imgFile.Close()
+	return jpeg.Encode(imgFile, img, nil)
+}
+
+// generateSprite creates a sprite-sheet with frames evenly spread across a movie,
+// plus a WebVTT- and a json-index for scrub-previews
+func generateSprite(ctx context.Context, mov *Movie, duration float64, outDir string) (*SpriteSheet, error) {
+	settings := thumbSettings.Sprite
+	numFrames := settings.Columns * settings.Rows
+
+	if numFrames <= 0 || settings.TileWidth <= 0 || duration <= 0 {
+		return nil, fmt.Errorf("invalid sprite-settings")
+	}
+
+	// keep the aspect-ratio, using an even tile-height
+	aspect := 9.0 / 16.0
+
+	if mov.Info != nil && mov.Info.Width > 0 && mov.Info.Height > 0 {
+		aspect = float64(mov.Info.Height) / float64(mov.Info.Width)
+	}
+	sprite := &SpriteSheet{
+		Image:      thumbRelPath(mov, "sprite.jpg"),
+		VTT:        thumbRelPath(mov, "sprite.vtt"),
+		Index:      thumbRelPath(mov, "sprite.json"),
+		TileWidth:  settings.TileWidth,
+		TileHeight: int(math.Round(float64(settings.TileWidth)*aspect/2)) * 2,
+		Columns:    settings.Columns,
+		Rows:       settings.Rows,
+		Interval:   duration / float64(numFrames),
+	}
+	filter := fmt.Sprintf("fps=1/%f,scale=%d:%d,tile=%dx%d", sprite.Interval,
+		sprite.TileWidth, sprite.TileHeight, sprite.Columns, sprite.Rows)
+
+	cmd := exec.CommandContext(ctx, FFMpegPath, "-v", "error", "-skip_frame", "nokey",
+		"-i", mov.Path, "-vf", filter, "-frames:v", "1", "-q:v", "4", "-y",
+		filepath.Join(outDir, sprite.Image))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// frame-locations, shared by both indices
+	frames := make([]SpriteFrame, numFrames)
+	vtt := &bytes.Buffer{}
+	vtt.WriteString("WEBVTT\n")
+
+	for i := range frames {
+		frames[i] = SpriteFrame{
+			Start: float64(i) * sprite.Interval,
+			End:   float64(i+1) * sprite.Interval,
+			X:     (i % sprite.Columns) * sprite.TileWidth,
+			Y:     (i / sprite.Columns) * sprite.TileHeight,
+		}
+		fmt.Fprintf(vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(frames[i].Start), vttTimestamp(frames[i].End), sprite.Image,
+			frames[i].X, frames[i].Y, sprite.TileWidth, sprite.TileHeight)
+	}
+
+	if err := os.WriteFile(filepath.Join(outDir, sprite.VTT), vtt.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+
+	index, _ := json.Marshal(struct {
+		*SpriteSheet
+		Frames []SpriteFrame `json:"frames"`
+	}{sprite, frames})
+
+	if err := os.WriteFile(filepath.Join(outDir, sprite.Index), index, 0644); err != nil {
+		return nil, err
+	}
+	return sprite, nil
+}
+
+// vttTimestamp formats seconds as WebVTT-timestamp 'hh:mm:ss.ttt'
+func vttTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
@@ -0,0 +1,158 @@
+package playlist
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+)
+
+// PlaybackSettings configures how playback is restored after a restart of player or backend
+type PlaybackSettings struct {
+	// ResumeOnReconnect re-sends the last playback once the player is connected,
+	// unless the player still plays the last movie
+	ResumeOnReconnect bool `json:"resume_on_reconnect"`
+}
+
+// LastPlayback is the last known playback, persisted to restore it after a restart
+type LastPlayback struct {
+	PlaylistIndex int    `json:"playlist_index"`
+	MovieIndex    int    `json:"movie_index"`
+	Path          string `json:"path"`
+
+	// Position inside the whole movie in seconds
+	Position float64   `json:"position"`
+	Playing  bool      `json:"playing"`
+	Saved    time.Time `json:"saved"`
+}
+
+// playbackSettings holds the active playback-settings
+var playbackSettings = PlaybackSettings{
+	ResumeOnReconnect: false,
+}
+
+var playbackSettingsFile = "playbackSettings.json"
+
+var lastPlaybackFile = "lastPlayback.json"
+
+// lastPlaybackInterval is the interval for saving the position of a running movie
+const lastPlaybackInterval = 5 * time.Second
+
+// LoadPlaybackSettings reads the playback-settings from their json-file, if present.
+// settings missing in the file keep their defaults
+func LoadPlaybackSettings() PlaybackSettings {
+	if err := jsonfile.Load(playbackSettingsFile, &playbackSettings); err != nil {
+		logger.Error("could not parse playback-settings", "error", err)
+	}
+	return playbackSettings
+}
+
+// loadLastPlayback reads the last playback from its json-file.
+// return: nil, if no playback was saved
+func loadLastPlayback() *LastPlayback {
+	jsonFile, err := os.Open(lastPlaybackFile)
+
+	if err != nil {
+		return nil
+	}
+	defer jsonFile.Close()
+
+	last := &LastPlayback{}
+
+	if err := json.NewDecoder(jsonFile).Decode(last); err != nil {
+		logger.Error("could not parse last playback", "error", err)
+		return nil
+	}
+	return last
+}
+
+// save writes the last playback to its json-file
+func (last *LastPlayback) save() {
+	if jsonBytes, err := json.MarshalIndent(last, "", "  "); err == nil {
+		if err := os.WriteFile(lastPlaybackFile, jsonBytes, 0644); err != nil {
+			logger.Error("could not save last playback", "error", err)
+		}
+	}
+}
+
+// differs returns true, if the state changed the playing movie or its play-state,
+// or if the saved position is out of date
+func (last *LastPlayback) differs(state *PlaybackState) bool {
+	return last.PlaylistIndex != state.PlaylistIndex || last.MovieIndex != state.MovieIndex ||
+		last.Path != state.Path || last.Playing != state.Playing ||
+		(state.Playing && time.Since(last.Saved) > lastPlaybackInterval)
+}
+
+// trackPlayback persists the current movie and position of playlists,
+// inserted items and interrupting clips are not persisted. requires a locked stateMutex
+func (updater *PlaybackStateUpdater) trackPlayback() *LastPlayback {
+	state := updater.state
+
+	if !state.Connected || state.Path == "" || state.MovieIndex < 0 || state.Inserted || state.Interrupted {
+		return nil
+	}
+
+	if updater.lastPlayback != nil && !updater.lastPlayback.differs(state) {
+		return nil
+	}
+	updater.lastPlayback = &LastPlayback{
+		PlaylistIndex: state.PlaylistIndex,
+		MovieIndex:    state.MovieIndex,
+		Path:          state.Path,
+		Position:      state.MoviePosition,
+		Playing:       state.Playing,
+		Saved:         time.Now(),
+	}
+	last := *updater.lastPlayback
+	return &last
+}
+
+// restorable returns true, if the last playback should be restored after the player reconnected.
+// requires a locked stateMutex
+func (updater *PlaybackStateUpdater) restorable() bool {
+	last := updater.lastPlayback
+
+	if !playbackSettings.ResumeOnReconnect || last == nil || !last.Playing {
+		return false
+	}
+
+	// the player kept playing, only the connection was lost
+	return !updater.state.Playing || updater.state.Path != last.Path
+}
+
+// restore re-sends the last playback, continuing at its movie and position.
+// if the playlist changed, the movie is searched by its path
+func (updater *PlaybackStateUpdater) restore() {
+	updater.stateMutex.RLock()
+	last := *updater.lastPlayback
+	updater.stateMutex.RUnlock()
+
+	list := getPlaylist(last.PlaylistIndex)
+
+	if list == nil {
+		logger.Warn("could not restore playback, unknown playlist", "playlist_index", last.PlaylistIndex)
+		return
+	}
+	movieIndex := -1
+
+	movieMutex.RLock()
+	if last.MovieIndex < len(list.Movies) && list.Movies[last.MovieIndex].Path == last.Path {
+		movieIndex = last.MovieIndex
+	} else {
+		for i, entry := range list.Movies {
+			if entry.Path == last.Path {
+				movieIndex = i
+				break
+			}
+		}
+	}
+	movieMutex.RUnlock()
+
+	if movieIndex < 0 {
+		logger.Warn("could not restore playback, movie not in playlist", "path", last.Path)
+		return
+	}
+	logger.Info("restore playback", "path", last.Path, "position", last.Position)
+	updater.playback(movieIndex, last.PlaylistIndex, last.Position, "")
+}
@@ -0,0 +1,395 @@
+package playlist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/notify"
+)
+
+// LibraryChange lists the movie-paths affected by an incremental library update.
+// removed movies are kept as missing, missing movies that re-appear are listed as added
+type LibraryChange struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+
+	// Renamed maps old paths to new paths of renamed or moved movies.
+	// renames are detected while indexing in background and reported by a change of their own
+	Renamed map[string]string `json:"renamed"`
+}
+
+// Empty returns true if no movies were added, removed, changed or renamed
+func (change *LibraryChange) Empty() bool {
+	return len(change.Added) == 0 && len(change.Removed) == 0 &&
+		len(change.Changed) == 0 && len(change.Renamed) == 0
+}
+
+// ThumbnailProgress reports the progress of a running thumbnail generation
+type ThumbnailProgress struct {
+	Path     string `json:"path"`
+	IconPath string `json:"icon"`
+	State    string `json:"state"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LibraryEvents receives a LibraryChange for every non-empty library update
+var LibraryEvents chan<- *LibraryChange
+
+// ThumbnailEvents receives progress-information during thumbnail generation
+var ThumbnailEvents chan<- *ThumbnailProgress
+
+// UpdateLibrary re-examines the provided paths (movie-files or directories)
+// and incrementally adds, removes or refreshes the affected movies.
+// paths outside of all media-roots are ignored.
+// new or changed movies are indexed and thumbnailed by the pipeline in the background,
+// renamed movies are reported by a separate LibraryChange, once detected
+func UpdateLibrary(paths []string) *LibraryChange {
+	change := &LibraryChange{Renamed: map[string]string{}}
+
+	for _, p := range paths {
+		root := rootForPath(p)
+
+		if root == nil {
+			continue
+		}
+		info, err := os.Stat(p)
+
+		if err != nil {
+			// path is gone, remove all movies at or below it
+			change.Removed = append(change.Removed, knownMoviesBelow(p, nil)...)
+			continue
+		}
+
+		for _, f := range root.findMovieFiles(p) {
+			if !isKnownMovie(f) {
+				change.Added = append(change.Added, f)
+			} else if !info.IsDir() {
+				// a known movie-file was touched directly
+				change.Changed = append(change.Changed, f)
+			}
+		}
+	}
+	applyLibraryChange(change)
+	return change
+}
+
+// Rescan compares the movies inside the provided media-roots with the current library
+// and incrementally applies all differences, indexing new movies in the background like UpdateLibrary
+func Rescan(roots []*MediaRoot) *LibraryChange {
+	change := &LibraryChange{Renamed: map[string]string{}}
+
+	for _, root := range roots {
+		logger.Info("rescanning media directory", "path", root.Path)
+		onDisk := make(map[string]bool)
+
+		for _, f := range root.findMovieFiles(root.Path) {
+			onDisk[f] = true
+
+			if !isKnownMovie(f) {
+				change.Added = append(change.Added, f)
+			}
+		}
+
+		for _, p := range knownMoviesBelow(root.Path, root) {
+			if !onDisk[p] {
+				change.Removed = append(change.Removed, p)
+			}
+		}
+	}
+	applyLibraryChange(change)
+	return change
+}
+
+// isKnownMovie returns true if the provided path is part of the library and not missing
+func isKnownMovie(path string) bool {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+	mov, ok := movieMap[path]
+	return ok && !mov.Missing
+}
+
+// knownMoviesBelow returns the paths of all available movies
+// that equal the provided path or are located below it.
+// if a media-root is provided, only movies belonging to that root are returned
+func knownMoviesBelow(path string, root *MediaRoot) (paths []string) {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	dirPrefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+
+	for _, mov := range movieMap {
+		if mov.Missing || (root != nil && rootForPath(mov.Path) != root) {
+			continue
+		}
+		if mov.Path == path || strings.HasPrefix(mov.Path, dirPrefix) {
+			paths = append(paths, mov.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// applyLibraryChange updates movieMap and the "All ..." playlists in place,
+// hands new and changed movies to the pipeline and broadcasts the change.
+// fingerprints, media-types and metadata are determined by the pipeline, so this returns immediately
+func applyLibraryChange(change *LibraryChange) {
+	if change.Empty() {
+		return
+	}
+	var added, changed []*Movie
+	movieMutex.Lock()
+
+	// keep removed movies, so they stay part of user playlists
+	for _, p := range change.Removed {
+		if mov, ok := movieMap[p]; ok {
+			mov.Missing = true
+		}
+	}
+
+	// new movies start with the media-type of their extension, until they are indexed
+	for _, p := range change.Added {
+		mov, ok := movieMap[p]
+
+		if !ok {
+			mov = &Movie{Path: p, Added: time.Now()}
+			mov.setType(extensionMediaType(p))
+			movieMap[p] = mov
+		}
+		mov.Missing = false
+		added = append(added, mov)
+	}
+
+	// custom thumbnails are dropped, once the movie-file changed
+	for _, p := range change.Changed {
+		if mov, ok := movieMap[p]; ok {
+			mov.CustomIcon = false
+			changed = append(changed, mov)
+		}
+	}
+
+	logger.Info("library changed", "added", len(change.Added), "removed", len(change.Removed),
+		"changed", len(change.Changed), "renamed", len(change.Renamed))
+
+	// rebuild "All ..." playlists, keeping them sorted by path
+	playlistMutex.Lock()
+	rebuildLibraryPlaylists()
+	playlistMutex.Unlock()
+	movieMutex.Unlock()
+
+	// changed movies need a fresh thumbnail
+	thumbMutex.Lock()
+	for _, p := range change.Changed {
+		delete(IconMap, p)
+	}
+	thumbMutex.Unlock()
+
+	// re-appearing movies keep their thumbnail
+	movieMutex.Lock()
+	thumbMutex.RLock()
+	for _, mov := range added {
+		if iconPath, ok := IconMap[mov.Path]; ok {
+			mov.IconPath = iconPath
+		}
+	}
+	thumbMutex.RUnlock()
+	movieMutex.Unlock()
+
+	enqueueIndexing(added, true, PriorityNew)
+	enqueueIndexing(changed, false, PriorityNew)
+
+	if len(change.Changed) > 0 {
+		saveIconMap()
+	}
+
+	// notify listeners, never block
+	select {
+	case LibraryEvents <- change:
+	default:
+		metrics.DroppedEvents.Inc("library")
+	}
+	alertLibraryChange(change)
+}
+
+// indexMovie fingerprints a new or changed movie, detects its media-type and probes its metadata.
+// an added movie with the fingerprint of a missing movie was renamed or moved,
+// so the missing record is moved to the new path and replaces the added one.
+// changed movies are always fingerprinted again, their content differs from the known fingerprint.
+// the movieMutex must not be locked by the caller.
+// return: the movie's record, which differs from the provided one for renamed movies
+func indexMovie(mov *Movie, added bool) *Movie {
+	movieMutex.RLock()
+	path, fingerprint := mov.Path, mov.Fingerprint
+	movieMutex.RUnlock()
+
+	if fingerprint == "" || !added {
+		fingerprint, _ = Fingerprint(path)
+	}
+	mediaType := detectMediaType(path)
+	var renamed map[string]string
+
+	movieMutex.Lock()
+	mov.Fingerprint = fingerprint
+
+	// the added record gives way to a matching missing record
+	if added && movieMap[path] == mov {
+		delete(movieMap, path)
+
+		if renamed = reassociateMoved(map[string]string{path: fingerprint}); len(renamed) > 0 {
+			mov = movieMap[path]
+
+			playlistMutex.Lock()
+			rebuildLibraryPlaylists()
+			playlistMutex.Unlock()
+		} else {
+			movieMap[path] = mov
+		}
+	}
+	mov.setType(mediaType)
+	movieMutex.Unlock()
+
+	if _, err := mov.probe(false); err != nil {
+		logger.Warn("could not probe movie", "path", path, "error", err)
+	}
+
+	if len(renamed) > 0 {
+		saveIconMap()
+
+		// notify listeners, never block
+		change := &LibraryChange{Renamed: renamed}
+
+		select {
+		case LibraryEvents <- change:
+		default:
+			metrics.DroppedEvents.Inc("library")
+		}
+		alertLibraryChange(change)
+	}
+	return mov
+}
+
+// alertLibraryChange sends a notification, summarizing a library-change
+func alertLibraryChange(change *LibraryChange) {
+	notify.Send(&notify.Alert{
+		Event:    notify.EventLibraryChanged,
+		Severity: notify.SeverityInfo,
+		Title:    "library changed",
+		Message: fmt.Sprintf("%d added, %d removed, %d changed, %d renamed",
+			len(change.Added), len(change.Removed), len(change.Changed), len(change.Renamed)),
+		Data: change,
+	})
+}
+
+// sendThumbnailProgress pushes a ThumbnailProgress to ThumbnailEvents, if possible
+func sendThumbnailProgress(progress *ThumbnailProgress) {
+	select {
+	case ThumbnailEvents <- progress:
+	default:
+		metrics.DroppedEvents.Inc("thumbnail")
+	}
+}
+
+// NumMovies returns the number of movies in the library and how many of them are missing
+func NumMovies() (int, int) {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	missing := 0
+
+	for _, mov := range movieMap {
+		if mov.Missing {
+			missing++
+		}
+	}
+	return len(movieMap), missing
+}
+
+// GetOrphans returns all movies that are currently missing on disk
+func GetOrphans() []*Movie {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	orphans := []*Movie{}
+
+	for _, mov := range movieMap {
+		if mov.Missing {
+			orphans = append(orphans, mov)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Path < orphans[j].Path })
+	return orphans
+}
+
+// PurgeOrphans removes the provided missing movies from the library and all playlists.
+// if no paths are provided, all missing movies are purged.
+// return: the paths of all purged movies
+func PurgeOrphans(paths []string) []string {
+	purge := make(map[string]bool)
+
+	if len(paths) == 0 {
+		for _, mov := range GetOrphans() {
+			purge[mov.Path] = true
+		}
+	} else {
+		for _, p := range paths {
+			purge[p] = true
+		}
+	}
+
+	purged := []string{}
+	movieMutex.Lock()
+
+	for p := range purge {
+		// only purge movies that are actually missing
+		if mov, ok := movieMap[p]; ok && mov.Missing {
+			delete(movieMap, p)
+			purged = append(purged, p)
+		} else {
+			delete(purge, p)
+		}
+	}
+
+	playlistMutex.Lock()
+	for _, list := range playlists {
+		movies := list.Movies[:0:0]
+
+		for _, mov := range list.Movies {
+			if !purge[mov.Path] {
+				movies = append(movies, mov)
+			}
+		}
+		list.Movies = movies
+	}
+	playlistMutex.Unlock()
+	movieMutex.Unlock()
+
+	thumbMutex.Lock()
+	for _, p := range purged {
+		delete(IconMap, p)
+	}
+	thumbMutex.Unlock()
+
+	if len(purged) > 0 {
+		sort.Strings(purged)
+		logger.Info("purged missing movies", "movies", len(purged))
+		saveIconMap()
+
+		// notify listeners, never block
+		change := &LibraryChange{Removed: purged}
+
+		select {
+		case LibraryEvents <- change:
+		default:
+			metrics.DroppedEvents.Inc("library")
+		}
+		alertLibraryChange(change)
+	}
+	return purged
+}
@@ -0,0 +1,182 @@
+package playlist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakape/thumbnailer"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+)
+
+// media-types of playlist items
+const (
+	MediaTypeVideo = "video"
+	MediaTypeImage = "image"
+	MediaTypeAudio = "audio"
+)
+
+// MediaTypeSettings configures which files are recognised as media
+type MediaTypeSettings struct {
+	VideoExtensions []string `json:"video_extensions"`
+	ImageExtensions []string `json:"image_extensions"`
+	AudioExtensions []string `json:"audio_extensions"`
+
+	// Sniff enables content-detection via ffmpeg,
+	// for files with unknown, missing or wrong extensions
+	Sniff bool `json:"sniff"`
+
+	// ImageDuration is the default display-duration for still images in seconds
+	ImageDuration float64 `json:"image_duration"`
+}
+
+// mediaTypes holds the active media-type settings
+var mediaTypes = MediaTypeSettings{
+	VideoExtensions: []string{".mp4", ".mov", ".m4v", ".mkv", ".avi"},
+	ImageExtensions: []string{".jpg", ".jpeg", ".png", ".bmp", ".tif", ".tiff", ".webp"},
+	AudioExtensions: []string{".mp3", ".wav", ".aac", ".m4a", ".flac", ".ogg"},
+	Sniff:           false,
+	ImageDuration:   10,
+}
+
+var mediaTypesFile = "mediaTypes.json"
+
+// codecs used for still images, also used by ffmpeg for embedded cover-art
+var stillImageCodecs = map[string]bool{
+	"mjpeg": true,
+	"png":   true,
+	"bmp":   true,
+	"tiff":  true,
+	"webp":  true,
+}
+
+// codecs ffmpeg reports for text-files, which we do not consider media
+var textCodecs = map[string]bool{
+	"ansi":    true,
+	"bintext": true,
+	"xbin":    true,
+	"idf":     true,
+}
+
+// sniffEntry caches the content-detection result for a file
+type sniffEntry struct {
+	size      int64
+	modTime   time.Time
+	mediaType string
+}
+
+var sniffCache = make(map[string]sniffEntry)
+
+var sniffMutex sync.Mutex
+
+// LoadMediaTypes reads the media-type settings from their json-file, if present.
+// settings missing in the file keep their defaults
+func LoadMediaTypes() MediaTypeSettings {
+	if err := jsonfile.Load(mediaTypesFile, &mediaTypes); err != nil {
+		logger.Error("could not parse media-types", "error", err)
+	}
+	return mediaTypes
+}
+
+// extensionMediaType returns the media-type for the extension of the provided path
+// or an empty string, if the extension is unknown
+func extensionMediaType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if ext == "" {
+		return ""
+	}
+
+	for mediaType, extensions := range map[string][]string{
+		MediaTypeVideo: mediaTypes.VideoExtensions,
+		MediaTypeImage: mediaTypes.ImageExtensions,
+		MediaTypeAudio: mediaTypes.AudioExtensions,
+	} {
+		for _, e := range extensions {
+			if strings.ToLower(e) == ext {
+				return mediaType
+			}
+		}
+	}
+	return ""
+}
+
+// detectMediaType returns the media-type of the provided file or an empty string, if it is no media.
+// if sniffing is enabled, the file-content takes precedence over its extension
+func detectMediaType(path string) string {
+	extType := extensionMediaType(path)
+
+	// never sniff hidden files
+	if !mediaTypes.Sniff || strings.HasPrefix(filepath.Base(path), ".") {
+		return extType
+	}
+
+	if sniffed := sniffMediaTypeCached(path); sniffed != "" {
+		return sniffed
+	}
+	return extType
+}
+
+// sniffMediaTypeCached returns a cached content-detection result,
+// as long as the file did not change
+func sniffMediaTypeCached(path string) string {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return ""
+	}
+	sniffMutex.Lock()
+	entry, ok := sniffCache[path]
+	sniffMutex.Unlock()
+
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.mediaType
+	}
+	entry = sniffEntry{size: info.Size(), modTime: info.ModTime(), mediaType: sniffMediaType(path)}
+
+	sniffMutex.Lock()
+	sniffCache[path] = entry
+	sniffMutex.Unlock()
+	return entry.mediaType
+}
+
+// sniffMediaType opens the provided file with ffmpeg and derives its media-type from the contained streams
+func sniffMediaType(path string) string {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	context, contextErr := thumbnailer.NewFFContext(file)
+
+	if contextErr != nil {
+		return ""
+	}
+	defer context.Close()
+
+	hasVideo, _ := context.HasStream(thumbnailer.FFVideo)
+	hasAudio, _ := context.HasStream(thumbnailer.FFAudio)
+	var videoCodec string
+
+	if hasVideo {
+		videoCodec, _ = context.CodecName(thumbnailer.FFVideo)
+		hasVideo = !textCodecs[videoCodec]
+	}
+
+	switch {
+	case hasVideo && stillImageCodecs[videoCodec] && hasAudio:
+		// audio with embedded cover-art
+		return MediaTypeAudio
+	case hasVideo && stillImageCodecs[videoCodec] && context.Duration() < time.Second:
+		return MediaTypeImage
+	case hasVideo:
+		return MediaTypeVideo
+	case hasAudio:
+		return MediaTypeAudio
+	}
+	return ""
+}
@@ -1,34 +1,71 @@
 package playlist
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"image"
-	"image/jpeg"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/bakape/thumbnailer"
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/command"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
 )
 
-// Playlist groups information for a playlist of movies
+var logger = logging.New("playlist")
+
+// Playlist groups information for a playlist of movies.
+// Mode, Transition and Movies of shared playlists are written holding the movieMutex and playlistMutex,
+// so they can be read holding either of them
 type Playlist struct {
-	Title  string   `json:"title"`
-	Movies []*Movie `json:"movies"`
+	Title string `json:"title"`
+
+	// Type is one of PlaylistTypeLibrary, PlaylistTypeManual or PlaylistTypeSmart
+	Type string `json:"type"`
+
+	// Rules select the movies of smart playlists
+	Rules *MovieQuery `json:"rules,omitempty"`
+
+	// Mode sets the play-order, defaults to sequential playback
+	Mode *PlayMode `json:"mode,omitempty"`
+
+	// Transition between items, unless set per entry. defaults to cuts
+	Transition *Transition `json:"transition,omitempty"`
+
+	Movies []*PlaylistEntry `json:"movies"`
+
+	// summaries are encoded without their movies
+	summary bool
 }
 
 // Movie groups information about a movie-file
 type Movie struct {
-	Path     string  `json:"path"`
-	Duration float64 `json:"duration"`
-	Delay    float64 `json:"delay"`
-	IconPath string  `json:"icon"`
+	Path        string            `json:"path"`
+	Duration    float64           `json:"duration"`
+	Delay       float64           `json:"delay"`
+	IconPath    string            `json:"icon"`
+	Missing     bool              `json:"missing"`
+	Fingerprint string            `json:"fingerprint"`
+	Root        string            `json:"root"`
+	Type        string            `json:"type"`
+	Info        *MediaInfo        `json:"info,omitempty"`
+	Thumbs      map[string]string `json:"thumbs"`
+	Sprite      *SpriteSheet      `json:"sprite,omitempty"`
+	AV          *AVSettings       `json:"av,omitempty"`
+	PosterTime  *float64          `json:"poster_time,omitempty"`
+	CustomIcon  bool              `json:"custom_icon,omitempty"`
+
+	// user-editable metadata
+	Title string    `json:"title"`
+	Tags  []string  `json:"tags"`
+	Notes string    `json:"notes"`
+	Added time.Time `json:"added"`
 }
 
 // PlaybackState groups information for the current playback state
@@ -42,6 +79,30 @@ type PlaybackState struct {
 	Volume        float64 `json:"volume"`
 	Rate          float64 `json:"rate"`
 	Playing       bool    `json:"playing"`
+
+	// position and duration inside the whole movie, Position and Duration refer to the trimmed range
+	MoviePosition float64 `json:"movie_position"`
+	MovieDuration float64 `json:"movie_duration"`
+
+	// derived timing-information
+	MovieRemaining    float64        `json:"movie_remaining"`
+	PlaylistRemaining float64        `json:"playlist_remaining"`
+	PlaylistDuration  float64        `json:"playlist_duration"`
+	LoopRestart       time.Time      `json:"loop_restart"`
+	Upcoming          []UpcomingItem `json:"upcoming"`
+
+	// play-order of the active playlist
+	PlayMode      string `json:"play_mode"`
+	OrderPosition int    `json:"order_position"`
+	OrderLength   int    `json:"order_length"`
+	Pass          int    `json:"pass"`
+	Passes        int    `json:"passes"`
+	Finished      bool   `json:"finished"`
+
+	// Inserted is true while an item of the play-next queue is played,
+	// Interrupted while an interrupting clip is played
+	Inserted    bool `json:"inserted"`
+	Interrupted bool `json:"interrupted"`
 }
 
 // NewPlaybackState creates the default playbackstate
@@ -63,8 +124,38 @@ type PlaybackStateUpdater struct {
 	timeOut    time.Duration
 	ticker     *time.Ticker
 	stateMutex sync.RWMutex
+
+	// maps the player's movie-indices to indices in the playlist,
+	// which differ if missing movies were skipped or the play-mode reorders the playlist.
+	// inserted items, which are not part of the playlist, use an index of -1
+	playerIndices []int
+
+	// the entries sent to the player, in the order of playerIndices
+	playerEntries []*PlaylistEntry
+
+	// playback to resume after an interrupting clip
+	resume *resumePoint
+
+	// persisted playback, restored after the player reconnected
+	lastPlayback *LastPlayback
+
+	// checks every state-update, nil if disabled
+	watchdog *watchdog
+
+	// play-mode of the active playlist
+	mode PlayMode
+
+	// the expected end of the current pass and a timer, which fires shortly before it,
+	// since the player would wrap around otherwise. generation invalidates pending timers,
+	// once a new order was sent
+	passEnd    time.Time
+	passTimer  *time.Timer
+	generation int
 }
 
+// passEndLead is the time a pass is ended early, to send the next order before the player wraps around
+const passEndLead = 50 * time.Millisecond
+
 // NewPlaybackStateUpdater creates a new instance
 func NewPlaybackStateUpdater(
 	ip string,
@@ -76,7 +167,10 @@ func NewPlaybackStateUpdater(
 		timeOut: timeOut,
 		output:  output,
 		Done:    make(chan bool),
+
+		lastPlayback: loadLastPlayback(),
 	}
+	ret.watchdog = newWatchdog(ret)
 	go ret.worker()
 	return ret
 }
@@ -95,24 +189,7 @@ func (updater *PlaybackStateUpdater) SetState(state PlaybackState) {
 	*updater.state = state
 }
 
-// UpdateMovieSettings looks up the provided movie by path
-// and updates its settings, if found
-func UpdateMovieSettings(movie *Movie) {
-	if movie != nil {
-		movieMutex.Lock()
-
-		if m, ok := movieMap[movie.Path]; ok {
-			m.Delay = movie.Delay
-			movieMap[movie.Path] = m
-			// log.Println("movieSettings updated:", m)
-		}
-		movieMutex.Unlock()
-		SetPlaylists(playlists[1:])
-	}
-}
-
 func (updater *PlaybackStateUpdater) worker() {
-	// defer log.Println("transmit done:", cmd)
 
 	responseBuffer := make([]byte, 1<<11)
 	requestStateCmd := &command.Command{Command: "playstate"}
@@ -128,59 +205,465 @@ func (updater *PlaybackStateUpdater) worker() {
 		case <-updater.ticker.C:
 			ack := command.Send(requestStateCmd, updater.Address, responseBuffer)
 			updater.stateMutex.Lock()
+			action := orderContinue
+			trimmed := false
+			var current *PlaylistEntry
 
 			if ack.Success {
+				prevMovieIndex := updater.state.MovieIndex
+				wasConnected := updater.state.Connected
+				updater.state.MovieIndex = -1
+
 				if err := json.Unmarshal([]byte(ack.Value), updater.state); err == nil {
 					// state updated
 					updater.state.Connected = true
+					trimmed = true
+
+					if !wasConnected {
+						logger.Info("player connected", "address", updater.Address)
+
+						// player or backend restarted
+						if updater.restorable() {
+							action = orderRestore
+						}
+					}
 				} else {
-					// log.Println("could not parse playbackstate")
+					logger.Debug("could not parse playstate", "error", err)
+				}
+
+				// translate the player's movie-index back to our playlist
+				if updater.state.MovieIndex < 0 {
+					updater.state.MovieIndex = prevMovieIndex
+				} else if playerIndex := updater.state.MovieIndex; playerIndex < len(updater.playerIndices) &&
+					action != orderRestore {
+					updater.state.OrderPosition = playerIndex
+					updater.state.MovieIndex = updater.playerIndices[playerIndex]
+					updater.state.Inserted = updater.state.MovieIndex < 0 && updater.resume == nil
+					current = updater.playerEntries[playerIndex]
 				}
 			} else {
-				// log.Println("player not reachable")
+				if updater.state.Connected {
+					logger.Warn("player not reachable", "address", updater.Address)
+				}
 				updater.state.Connected = false
 				updater.state.Path = ""
 				updater.state.Position = 0
 				updater.state.Duration = 0
 				updater.state.Playing = false
 			}
+			list := getPlaylist(updater.state.PlaylistIndex)
+
+			// the playlist changed while playing, e.g. a re-evaluated smart playlist
+			if action == orderContinue && updater.state.Playing && !updater.state.Finished &&
+				updater.outdated(list) {
+				action = orderRemap
+			}
+
+			// the player reports positions inside the whole movie
+			if trimmed {
+				updater.state.applyTrim(current)
+			}
+			updater.state.updateTiming(list, updater.playerIndices, updater.playerEntries,
+				updater.repeats(), time.Now())
+
+			if action == orderContinue {
+				updater.schedulePassEnd(time.Now())
+			}
 			updater.output <- updater.state
+
+			// restored playback is persisted once it started
+			var last *LastPlayback
+
+			if action != orderRestore {
+				last = updater.trackPlayback()
+			}
+			updater.watchdog.push(*updater.state)
 			updater.stateMutex.Unlock()
+
+			if last != nil {
+				last.save()
+			}
+
+			updater.apply(action)
 		}
 	}
 }
 
-// Playback sets a new playlist-index and optionally a new playlist
-func (updater *PlaybackStateUpdater) Playback(movieIndex int, playlistIndex int) {
+// apply takes an action resulting from a state-update or the end of a pass.
+// requires an unlocked stateMutex
+func (updater *PlaybackStateUpdater) apply(action int) {
+	switch action {
+	case orderReorder:
+		updater.reorder()
+	case orderStop:
+		command.Send(&command.Command{Command: "pause"}, updater.Address, nil)
+	case orderResume:
+		updater.Resume("")
+	case orderRestore:
+		updater.restore()
+	case orderRemap:
+		updater.remap()
+	}
+}
+
+// schedulePassEnd starts a timer for the end of the current pass, once it ends before the next state-update.
+// requires a locked stateMutex
+func (updater *PlaybackStateUpdater) schedulePassEnd(now time.Time) {
+	state := updater.state
+
+	// the end of the current pass is already scheduled, or the player did not wrap around yet
+	if now.Before(updater.passEnd.Add(passEndLead)) {
+		return
+	}
+
+	if !state.Connected || !state.Playing || state.Finished ||
+		state.OrderPosition < 0 || state.OrderPosition >= len(updater.playerEntries) {
+		return
+	}
+	remaining := time.Duration(state.PlaylistRemaining * float64(time.Second))
+
+	// the next state-update is early enough
+	if remaining > updater.timeOut+passEndLead {
+		return
+	}
+	updater.passEnd = now.Add(remaining)
+	updater.startPassTimer(now)
+}
+
+// startPassTimer starts the timer for passEnd. a stopping playback ends with its last item,
+// without the item's delay. requires a locked stateMutex
+func (updater *PlaybackStateUpdater) startPassTimer(now time.Time) {
+	end := updater.passEnd.Sub(now) - passEndLead
+
+	if updater.resume == nil && updater.stops() {
+		movieMutex.RLock()
+		delay := updater.playerEntries[len(updater.playerEntries)-1].Delay
+		movieMutex.RUnlock()
+		end -= time.Duration(delay * float64(time.Second))
+	}
+
+	if end < 0 {
+		end = 0
+	}
+	generation := updater.generation
+	updater.passTimer = time.AfterFunc(end, func() { updater.endPass(generation) })
+}
+
+// stops returns true if playback stops after the current pass. requires a locked stateMutex
+func (updater *PlaybackStateUpdater) stops() bool {
+	passes := updater.mode.passes()
+	return passes > 0 && updater.state.Pass >= passes
+}
+
+// endPass ends the current pass through the play-order, scheduled by schedulePassEnd
+func (updater *PlaybackStateUpdater) endPass(generation int) {
+	updater.stateMutex.Lock()
+
+	// a new order was sent in the meantime
+	if generation != updater.generation {
+		updater.stateMutex.Unlock()
+		return
+	}
+	action := updater.nextPass()
+
+	// the player wraps around on its own, passes shorter than the state-updates are chained
+	if action == orderContinue && !updater.state.Finished {
+		if duration := updater.passDuration(); duration > 0 && duration <= updater.timeOut {
+			updater.passEnd = updater.passEnd.Add(duration)
+			updater.startPassTimer(time.Now())
+		}
+	}
+	updater.stateMutex.Unlock()
+
+	updater.apply(action)
+}
+
+// nextPass advances to the next pass through the play-order.
+// return: the action to take, once the stateMutex is released. requires a locked stateMutex
+func (updater *PlaybackStateUpdater) nextPass() int {
+	// an interrupting clip ended
+	if updater.resume != nil {
+		return orderResume
+	}
+
+	if updater.state.Finished {
+		return orderContinue
+	}
+
+	if updater.stops() {
+		logger.Info("playback finished", "passes", updater.state.Pass)
+		updater.state.Finished = true
+		return orderStop
+	}
+	updater.state.Pass++
+
+	// played items of the play-next queue are removed by sending a new order
+	if updater.mode.random() || hasInserted(updater.playerIndices) {
+		return orderReorder
+	}
+	return orderContinue
+}
+
+// passDuration returns the runtime of a whole pass through the current order. requires a locked stateMutex
+func (updater *PlaybackStateUpdater) passDuration() time.Duration {
+	list := getPlaylist(updater.state.PlaylistIndex)
+
+	if list == nil {
+		return 0
+	}
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+	var duration float64
+
+	for i, entry := range updater.playerEntries {
+		duration += entry.itemRuntime()
+
+		// cross-fades start before their predecessor ends
+		if i > 0 {
+			duration -= list.transition(entry).overlap()
+		}
+	}
+	return time.Duration(duration * float64(time.Second))
+}
+
+// repeats returns true if the current play-order is repeated after the current pass.
+// requires a locked stateMutex
+func (updater *PlaybackStateUpdater) repeats() bool {
+	passes := updater.mode.passes()
+	return !updater.mode.random() && (passes == 0 || updater.state.Pass < passes)
+}
+
+// reorder sends a new play-order for the next pass of a random play-mode
+func (updater *PlaybackStateUpdater) reorder() {
+	updater.stateMutex.RLock()
+	playlistIndex := updater.state.PlaylistIndex
+	mode := updater.mode
+	last := -1
+
+	for i := len(updater.playerIndices) - 1; i >= 0 && last < 0; i-- {
+		last = updater.playerIndices[i]
+	}
+	updater.stateMutex.RUnlock()
+
+	list := getPlaylist(playlistIndex)
+
+	if list == nil {
+		return
+	}
+	movieMutex.RLock()
+	order := mode.order(list, -1, last)
+	movieMutex.RUnlock()
+
+	updater.send(list, playlistIndex, order, 0, 0, "")
+}
+
+// outdated returns true, if the movies sent to the player no longer match the provided playlist.
+// movies are compared by their paths, so the player continues, if only their indices changed.
+// requires a locked stateMutex
+func (updater *PlaybackStateUpdater) outdated(list *Playlist) bool {
+	// an interrupting clip is not part of the playlist
+	if list == nil || updater.resume != nil {
+		return false
+	}
+	movieMutex.RLock()
+	spliced := updater.mode.splice(list, updater.playerIndices, updater.playerEntries, updater.state.OrderPosition)
+	movieMutex.RUnlock()
+
+	if spliced.changed {
+		return true
+	}
+	updater.playerIndices = spliced.order
+
+	if pos := updater.state.OrderPosition; pos >= 0 && pos < len(spliced.order) {
+		updater.state.MovieIndex = spliced.order[pos]
+	}
+	return false
+}
+
+// remap sends the play-order of the active playlist again, after its movies changed.
+// the order is kept and the current movie continues at its position, if it is still part of the playlist
+func (updater *PlaybackStateUpdater) remap() {
+	updater.stateMutex.RLock()
+	playlistIndex := updater.state.PlaylistIndex
+	position := updater.state.MoviePosition
+	mode := updater.mode
+	order, entries := updater.playerIndices, updater.playerEntries
+	playerIndex := updater.state.OrderPosition
+	updater.stateMutex.RUnlock()
+
+	list := getPlaylist(playlistIndex)
+
+	if list == nil {
+		return
+	}
+	movieMutex.RLock()
+	spliced := mode.splice(list, order, entries, playerIndex)
+	movieMutex.RUnlock()
+
+	if !spliced.changed {
+		return
+	}
+
+	if spliced.removed {
+		position = 0
+	}
+	logger.Info("playlist changed, sending new play-order", "playlist", list.Title)
+	updater.transmit(list, playlistIndex, spliced.order, spliced.entries, spliced.playerIndex, position, "")
+}
+
+// Playback sets a new playlist-index and optionally a new playlist.
+// the play-order is computed from the playlist's play-mode.
+// requestID identifies the issuing http-request in the playback's ACK, empty for internal playbacks
+func (updater *PlaybackStateUpdater) Playback(movieIndex int, playlistIndex int, requestID string) {
+	updater.playback(movieIndex, playlistIndex, 0, requestID)
+}
+
+// playback starts the movie with the provided index at a position inside the whole movie
+func (updater *PlaybackStateUpdater) playback(movieIndex int, playlistIndex int, position float64,
+	requestID string) {
 
 	defer func() {
 		if err := recover(); err != nil {
-			log.Println(err)
+			logger.Error("playback failed", "error", err)
 		}
 	}()
 
-	var playlist []string
-	var delays []float64
-
 	if playlistIndex < 0 {
-		playlistIndex = updater.state.PlaylistIndex
+		playlistIndex = updater.GetState().PlaylistIndex
+	}
+	list := getPlaylist(playlistIndex)
+
+	if list == nil {
+		logger.Warn("playlist-index out of range", "playlist_index", playlistIndex)
+		return
+	}
+	playerIndex := 0
+
+	// random orders start with the selected movie, others continue with the next available one
+	movieMutex.RLock()
+	mode := list.playMode()
+	order := mode.order(list, movieIndex, -1)
+
+	if !mode.random() {
+		for i, index := range order {
+			if index >= movieIndex {
+				playerIndex = i
+				break
+			}
+		}
 	}
-	list := playlists[playlistIndex]
+	movieMutex.RUnlock()
 
-	// extract values from playlist
-	for _, mov := range list.Movies {
-		playlist = append(playlist, mov.Path)
-		delays = append(delays, mov.Delay)
+	// the position belongs to the selected movie only
+	if playerIndex >= len(order) || order[playerIndex] != movieIndex {
+		position = 0
+	}
+
+	updater.stateMutex.Lock()
+	updater.mode = mode
+	updater.resume = nil
+	updater.state.Interrupted = false
+	updater.state.PlayMode = mode.Mode
+	updater.state.Pass = 1
+	updater.state.Passes = mode.passes()
+	updater.state.Finished = false
+	updater.state.MovieIndex = movieIndex
+	updater.stateMutex.Unlock()
+
+	updater.send(list, playlistIndex, order, playerIndex, position, requestID)
+}
+
+// send transmits the provided play-order of a playlist to the player, starting at playerIndex
+// and the provided position inside its movie
+func (updater *PlaybackStateUpdater) send(list *Playlist, playlistIndex int, order []int, playerIndex int,
+	position float64, requestID string) {
+	entries := make([]*PlaylistEntry, len(order))
+
+	movieMutex.RLock()
+	for i, index := range order {
+		if index >= len(list.Movies) {
+			movieMutex.RUnlock()
+			logger.Warn("play-order out of date, playlist changed", "playlist", list.Title)
+			return
+		}
+		entries[i] = list.Movies[index]
+	}
+	movieMutex.RUnlock()
+
+	updater.transmit(list, playlistIndex, order, entries, playerIndex, position, requestID)
+}
+
+// transmit sends the provided entries to the player, starting at playerIndex and the provided position
+// inside its movie. order holds the playlist-indices of the entries.
+// a non-empty requestID is copied to the playback's ACK, which is pushed to PlaybackACKs
+func (updater *PlaybackStateUpdater) transmit(list *Playlist, playlistIndex int, order []int,
+	entries []*PlaylistEntry, playerIndex int, position float64, requestID string) {
+	items := &command.PlaybackItems{Position: position, RequestID: requestID}
+
+	// extract values from entries
+	movieMutex.RLock()
+	for _, entry := range entries {
+		start, end := entry.trim(0)
+		av := entry.av()
+		items.Paths = append(items.Paths, entry.Path)
+		items.Delays = append(items.Delays, entry.Delay)
+		items.Durations = append(items.Durations, entry.Duration)
+		items.Starts = append(items.Starts, start)
+		items.Ends = append(items.Ends, end)
+		items.Volumes = append(items.Volumes, entry.volume())
+		items.Rates = append(items.Rates, entry.rate())
+		items.AudioTracks = append(items.AudioTracks, av.AudioTrack)
+		items.Aspects = append(items.Aspects, av.Aspect)
+		items.FadeIns = append(items.FadeIns, av.FadeIn)
+		items.FadeOuts = append(items.FadeOuts, av.FadeOut)
+
+		transition := list.transition(entry)
+		items.Transitions = append(items.Transitions, transition.Type)
+		items.TransitionDurations = append(items.TransitionDurations, transition.Duration)
+	}
+	movieMutex.RUnlock()
+
+	if playerIndex >= len(items.Paths) {
+		playerIndex = 0
+	}
+	ack := command.Playback(updater.Address, playerIndex, items)
+
+	// playbacks issued by http-requests are acknowledged to their clients, never block
+	if requestID != "" {
+		select {
+		case PlaybackACKs <- ack:
+		default:
+			metrics.DroppedEvents.Inc("ack")
+		}
 	}
-	command.Playback(updater.Address, movieIndex, playlist, delays)
 
 	// set playlist index, since mediaplayer will not be aware of it
 	updater.stateMutex.Lock()
 	defer updater.stateMutex.Unlock()
 	updater.state.PlaylistIndex = playlistIndex
-	updater.state.MovieIndex = movieIndex
+
+	if playerIndex < len(order) {
+		updater.state.MovieIndex = order[playerIndex]
+	}
+	updater.state.OrderPosition = playerIndex
+	updater.state.OrderLength = len(order)
+	updater.state.Inserted = playerIndex < len(order) && order[playerIndex] < 0 && updater.resume == nil
+	updater.playerIndices = order
+	updater.playerEntries = entries
+
+	// pending pass-ends belong to the previous order
+	updater.generation++
+	updater.passEnd = time.Time{}
+
+	if updater.passTimer != nil {
+		updater.passTimer.Stop()
+		updater.passTimer = nil
+	}
 }
 
+// PlaybackACKs receives the ACKs of playbacks, which were issued by http-requests
+var PlaybackACKs chan<- *command.ACK
+
 // IconMap holds our icon-paths
 var IconMap map[string]string
 
@@ -204,8 +687,27 @@ func GetPlaylists() []*Playlist {
 	return playlists
 }
 
+// getPlaylist returns the playlist with the provided index or nil, if out of range
+func getPlaylist(index int) *Playlist {
+	playlistMutex.RLock()
+	defer playlistMutex.RUnlock()
+
+	if index < 0 || index >= len(playlists) {
+		return nil
+	}
+	return playlists[index]
+}
+
+// GetUserPlaylists returns a slice of all Playlists, excluding the synthesized "All ..." playlists
+func GetUserPlaylists() []*Playlist {
+	playlistMutex.RLock()
+	defer playlistMutex.RUnlock()
+	return playlists[numLibraryPlaylists():]
+}
+
 // SetPlaylists looks up items in the provided playlist slice by path
-// and updates all secondary lists with pointers from the global movieMap, if found
+// and updates all secondary lists with pointers from the global movieMap.
+// unknown movies are added to the movieMap, flagged as missing
 func SetPlaylists(p []*Playlist) {
 
 	var newLists []*Playlist
@@ -213,88 +715,143 @@ func SetPlaylists(p []*Playlist) {
 	defer movieMutex.Unlock()
 
 	for _, list := range p {
-		listCopy := &Playlist{Title: list.Title}
+		listCopy := &Playlist{Title: list.Title, Type: list.Type, Rules: list.Rules, Mode: list.Mode,
+			Transition: list.Transition}
 
-		for _, mov := range list.Movies {
-			if movPtr, ok := movieMap[mov.Path]; ok {
-				// movPtr.Delay = mov.Delay
-				// movieMap[mov.Path] = movPtr
-				listCopy.Movies = append(listCopy.Movies, movPtr)
+		if listCopy.Mode != nil {
+			if err := listCopy.Mode.validate(); err != nil {
+				logger.Warn("invalid play-mode", "playlist", list.Title, "error", err)
+				listCopy.Mode = nil
 			}
 		}
+
+		if listCopy.Transition != nil {
+			if err := listCopy.Transition.validate(); err != nil {
+				logger.Warn("invalid transition", "playlist", list.Title, "error", err)
+				listCopy.Transition = nil
+			}
+		}
+
+		// smart playlists are evaluated from their rules, an empty rule-set matches all movies
+		if listCopy.Type == PlaylistTypeSmart {
+			if listCopy.Rules == nil {
+				listCopy.Rules = &MovieQuery{}
+			}
+			listCopy.evaluate()
+			newLists = append(newLists, listCopy)
+			continue
+		}
+		listCopy.Type = PlaylistTypeManual
+
+		for _, entry := range list.Movies {
+			if entry == nil || entry.Movie == nil {
+				continue
+			}
+			movPtr, ok := movieMap[entry.Path]
+
+			if !ok {
+				// unknown movie, keep it as missing instead of dropping it
+				movPtr = &Movie{Path: entry.Path, Delay: entry.Delay, Missing: true}
+				movieMap[entry.Path] = movPtr
+			}
+
+			// entries keep their own settings
+			entryCopy := *entry
+			entryCopy.Movie = movPtr
+
+			if err := entryCopy.validate(); err != nil {
+				logger.Warn("invalid entry", "playlist", list.Title, "path", entry.Path, "error", err)
+				entryCopy = *newEntry(movPtr)
+			}
+			listCopy.Movies = append(listCopy.Movies, &entryCopy)
+		}
 		newLists = append(newLists, listCopy)
 	}
 	playlistMutex.Lock()
 	defer playlistMutex.Unlock()
 
-	if len(playlists) > 0 {
-		// update "All Movies" playlist
-		for i, mov := range playlists[0].Movies {
-			if movPtr, ok := movieMap[mov.Path]; ok {
-				playlists[0].Movies[i] = movPtr
+	// update "All ..." playlists
+	for _, list := range playlists[:numLibraryPlaylists()] {
+		for _, entry := range list.Movies {
+			if movPtr, ok := movieMap[entry.Path]; ok {
+				entry.Movie = movPtr
 			}
 		}
 	}
-	playlists = append(playlists[:1], newLists...)
+	playlists = append(playlists[:numLibraryPlaylists()], newLists...)
 }
 
 // Init will initialize the module state,
-// meaning it scans for movies, icons and saved playlists
+// meaning it scans all media-roots for movies, icons and saved playlists
 // and inits the IconMap and Playlists variables
-func Init(baseDir string) {
-	log.Println("(re-)init playlist module:", baseDir)
+func Init() {
+	logger.Info("(re-)init playlist module", "media_roots", len(getMediaRoots()))
 
 	if IconMap == nil {
 		IconMap = make(map[string]string)
 	}
 
-	// read user playlists from file
-	if iconFile, err := os.Open(thumbsFile); err == nil {
-		thumbMutex.Lock()
-		decoder := json.NewDecoder(iconFile)
-		decoder.Decode(&IconMap)
-		thumbMutex.Unlock()
-		log.Println("icons loaded:", len(IconMap))
+	// read icons from file
+	thumbMutex.Lock()
+	if err := jsonfile.Load(thumbsFile, &IconMap); err != nil {
+		logger.Error("could not parse icons", "error", err)
 	}
+	logger.Info("icons loaded", "icons", len(IconMap))
+	thumbMutex.Unlock()
 
-	// clear slice
-	playlists = playlists[:0]
-
-	// start with "All Movies" playlist
-	allMovies := &Playlist{Title: "All Movies", Movies: createMovieList(baseDir)}
+	numMovies := len(createMovieList())
 
-	// lock playlist mutex
+	// start with one "All ..." playlist per media-root
+	movieMutex.Lock()
 	playlistMutex.Lock()
-	playlists = append(playlists, allMovies)
+	playlists = playlists[:0]
+	rebuildLibraryPlaylists()
 	playlistMutex.Unlock()
+	movieMutex.Unlock()
 
 	// read user playlists from file
-	jsonFile, err := os.Open(playlistFile)
+	var loadedLists []*Playlist
 
-	if err != nil {
-		log.Println(err)
-		return
+	if err := jsonfile.Load(playlistFile, &loadedLists); err != nil {
+		logger.Error("could not parse playlists", "error", err)
 	}
-	defer jsonFile.Close()
-
-	var loadedLists []*Playlist
-	decoder := json.NewDecoder(jsonFile)
-	decoder.Decode(&loadedLists)
 
 	// append to playlists
 	SetPlaylists(loadedLists)
-	log.Printf("found %d movies and %d playlists\n", len(allMovies.Movies), len(playlists))
+	logger.Info("library loaded", "movies", numMovies, "playlists", len(playlists))
+}
+
+// EncodeJSON writes v as json to w. movies and playlists are encoded holding the movieMutex
+// and playlistMutex for reading, since background-workers update them concurrently.
+// the encoded bytes are written once both locks are released
+func EncodeJSON(w io.Writer, v interface{}) error {
+	movieMutex.RLock()
+	playlistMutex.RLock()
+	data, err := json.Marshal(v)
+	playlistMutex.RUnlock()
+	movieMutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
 }
 
 // Save will save the module state to one or more json-config files
 func Save(baseDir string) {
 	if jsonFile, err := os.Create(playlistFile); err == nil {
 		defer jsonFile.Close()
+
 		// encode playlist as json
-		enc := json.NewEncoder(jsonFile)
-		enc.SetIndent("", "  ")
-		enc.Encode(GetPlaylists()[1:])
-		log.Println("playlist JSON written to ", jsonFile.Name())
+		movieMutex.RLock()
+		playlistMutex.RLock()
+		data, _ := json.MarshalIndent(persistentPlaylists(playlists[numLibraryPlaylists():]), "", "  ")
+		playlistMutex.RUnlock()
+		movieMutex.RUnlock()
+
+		jsonFile.Write(append(data, '\n'))
+		logger.Debug("playlists written", "file", jsonFile.Name())
 	}
 
 	if dataFile, err := os.Create(movieDataFile); err == nil {
@@ -303,184 +860,318 @@ func Save(baseDir string) {
 		enc := json.NewEncoder(dataFile)
 		// enc.SetIndent("", "  ")
 		enc.Encode(movieMap)
-		log.Println("movie-database written to ", dataFile.Name())
+		logger.Debug("movie-database written", "file", dataFile.Name())
 		movieMutex.RUnlock()
 		dataFile.Close()
 	}
 }
 
-// createMovieList recursively walks a directory and returns a list of all movie files
-func createMovieList(baseDir string) (movies []*Movie) {
-
-	log.Println("scanning media directory:", baseDir)
+// createMovieList walks all media-roots and returns a list of all movie files.
+// known movies that could not be found are part of the list, flagged as missing
+func createMovieList() (movies []*Movie) {
 
 	if movieMap == nil {
 		movieMap = make(map[string]*Movie)
 
-		// read user playlists from file
-		if dataFile, err := os.Open(movieDataFile); err == nil {
-			movieMutex.Lock()
-			decoder := json.NewDecoder(dataFile)
-			decoder.Decode(&movieMap)
-			movieMutex.Unlock()
-			log.Println("movie database loaded:", len(movieMap))
-			dataFile.Close()
+		// read the movie-database from file
+		movieMutex.Lock()
+		if err := jsonfile.Load(movieDataFile, &movieMap); err != nil {
+			logger.Error("could not parse movie-database", "error", err)
 		}
+		logger.Info("movie database loaded", "movies", len(movieMap))
+		movieMutex.Unlock()
 	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("could not create movielist:", r)
+			logger.Error("could not create movielist", "error", r)
 		}
 	}()
 
-	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
-		panic(err)
+	var files []string
+
+	for _, root := range getMediaRoots() {
+		logger.Info("scanning media directory", "path", root.Path)
+
+		if _, err := os.Stat(root.Path); os.IsNotExist(err) {
+			logger.Error("could not scan media-root", "root", root.Name, "error", err)
+			continue
+		}
+		files = append(files, root.findMovieFiles(root.Path)...)
 	}
+	sort.Strings(files)
+
+	// flag all movies that could not be found on disk as missing
+	onDisk := make(map[string]bool)
 
-	movieExtensions := map[string]bool{
-		".mp4": true,
-		".mov": true,
-		".m4v": true,
-		".mkv": true,
-		".avi": true,
+	for _, f := range files {
+		onDisk[f] = true
+	}
+	movieMutex.Lock()
+	for p, mov := range movieMap {
+		mov.Missing = !onDisk[p]
 	}
+	movieMutex.Unlock()
 
-	var files []string
+	// fingerprint unknown files, to detect renamed or moved movies
+	fingerprints := make(map[string]string)
 
-	// walk the directory tree
-	filepath.Walk(baseDir, func(path string, f os.FileInfo, _ error) error {
-		if !f.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
+	for _, f := range files {
+		movieMutex.RLock()
+		_, known := movieMap[f]
+		movieMutex.RUnlock()
 
-			if _, isMovie := movieExtensions[ext]; isMovie {
-				// movies = append(movies, Movie{Path: path})
-				files = append(files, path)
+		if !known {
+			if fp, err := Fingerprint(f); err == nil {
+				fingerprints[f] = fp
 			}
 		}
-		return nil
-	})
-	sort.Strings(files)
+	}
+	movieMutex.Lock()
+	reassociateMoved(fingerprints)
+	movieMutex.Unlock()
 
 	for _, f := range files {
-		// log.Println(f)
+		logger.Debug("found movie-file", "path", f)
+
+		// files are examined without holding the movieMutex, pipeline-workers might be running
+		movieMutex.RLock()
+		fingerprint := fingerprints[f]
+
+		if mov, ok := movieMap[f]; ok {
+			fingerprint = mov.Fingerprint
+		}
+		movieMutex.RUnlock()
+
+		// fingerprint movies from older databases
+		if fingerprint == "" {
+			fingerprint, _ = Fingerprint(f)
+		}
+		mediaType := detectMediaType(f)
+
 		// protect insertion into map with mutex
 		movieMutex.Lock()
-		var mov *Movie
-		var ok bool
+		mov, ok := movieMap[f]
 
-		if mov, ok = movieMap[f]; !ok {
-			mov = &Movie{Path: f}
+		if !ok {
+			mov = &Movie{Path: f, Added: time.Now()}
 			movieMap[f] = mov
 		}
+
+		if mov.Fingerprint == "" {
+			mov.Fingerprint = fingerprint
+		}
+		mov.setType(mediaType)
 		movieMutex.Unlock()
 
+		// refresh metadata, if the file changed
+		if _, err := mov.probe(false); err != nil {
+			logger.Warn("could not probe movie", "path", f, "error", err)
+		}
+
+		movieMutex.Lock()
+		thumbMutex.RLock()
+
+		// movies from older databases were added when their file was written
+		if mov.Added.IsZero() {
+			if mov.Info != nil {
+				mov.Added = mov.Info.ModTime
+			} else {
+				mov.Added = time.Now()
+			}
+		}
+
 		if iconPath, ok := IconMap[f]; ok {
 			mov.IconPath = iconPath
 		}
+		thumbMutex.RUnlock()
+		movieMutex.Unlock()
+
 		movies = append(movies, mov)
 	}
+
+	// keep missing movies as part of the list
+	movieMutex.RLock()
+	for _, mov := range movieMap {
+		if mov.Missing {
+			movies = append(movies, mov)
+		}
+	}
+	movieMutex.RUnlock()
+	sort.Slice(movies, func(i, j int) bool { return movies[i].Path < movies[j].Path })
 	return movies
 }
 
+// setType sets the movie's media-type, still images receive the default display-duration
+func (mov *Movie) setType(mediaType string) {
+	mov.Type = mediaType
+
+	if mediaType == MediaTypeImage && mov.Duration <= 0 {
+		mov.Duration = mediaTypes.ImageDuration
+	}
+}
+
 // GenerateThumbnails scans the availability of thumbs for all movies
-// and genrates missing ones
-func GenerateThumbnails(mediaDir, outDir string) {
-	log.Println("GenerateThumbnails -> scanning for new movies")
-	_ = createMovieList(mediaDir)
+// and enqueues missing ones to the thumbnail-pipeline
+func GenerateThumbnails() {
+	var todo []*Movie
 
-	dirtyThumbs := false
+	movieMutex.Lock()
+	thumbMutex.RLock()
+	for _, mov := range movieMap {
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("recovered from", err)
+		// check for existing thumbnail
+		if mov.Missing {
+			continue
+		} else if p, hasIcon := IconMap[mov.Path]; hasIcon {
+			mov.IconPath = p
+		} else {
+			todo = append(todo, mov)
 		}
-	}()
+	}
+	thumbMutex.RUnlock()
+	movieMutex.Unlock()
+
+	logger.Info("missing thumbnails", "movies", len(todo))
+	enqueueThumbnails(todo, PriorityLow)
+}
+
+// thumbsDirRel is the thumbnail-directory, relative to the served output-directory
+const thumbsDirRel = "/img/thumbs"
+
+// generateThumbnail creates a thumbnail-image for the provided movie inside outDir
+// and updates the movie's IconPath, Duration and the IconMap accordingly.
+// the movie is read from a snapshot and only updated once all files are written,
+// holding the movieMutex, which must not be locked by the caller. thumbnails uploaded meanwhile are kept.
+// a cancelled context aborts the generation, before the movie is updated
+func generateThumbnail(ctx context.Context, shared *Movie, outDir string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	movieMutex.RLock()
+	snapshot := *shared
+	movieMutex.RUnlock()
+	mov := &snapshot
 
-	thumbsDirRel := "/img/thumbs"
 	thumbsDirAbs := filepath.Join(outDir, thumbsDirRel)
 
 	// create directory, if necessary
 	if dirErr := os.MkdirAll(thumbsDirAbs, os.ModePerm); dirErr != nil {
-		log.Println("could not create directory:", thumbsDirAbs)
-		return
+		logger.Error("could not create directory", "path", thumbsDirAbs, "error", dirErr)
+		return dirErr
 	}
 
-	movieMutex.RLock()
-	for _, mov := range movieMap {
+	// open movie-file
+	movieFile, err := os.Open(mov.Path)
 
-		// check for existing thumbnail
-		if p, hasIcon := IconMap[mov.Path]; hasIcon {
-			mov.IconPath = p
-		} else {
+	if err != nil {
+		logger.Warn("could not open movie file", "path", mov.Path, "error", err)
+		return err
+	}
+	defer movieFile.Close()
 
-			// we are about to change something
-			dirtyThumbs = true
+	context, contextErr := thumbnailer.NewFFContext(movieFile)
 
-			// open movie-file
-			if movieFile, err := os.Open(mov.Path); err == nil {
+	if contextErr != nil {
+		logger.Warn("could not open ffmpeg-context", "path", mov.Path, "error", contextErr)
+		return contextErr
+	}
+	defer context.Close()
 
-				context, contextErr := thumbnailer.NewFFContext(movieFile)
+	// get duration
+	movieDur := context.Duration().Seconds()
 
-				if contextErr != nil {
-					log.Println(contextErr)
-					continue
-				}
-				// get duration
-				movieDur := context.Duration().Seconds()
+	logger.Debug("generating thumbnail", "path", movieFile.Name())
 
-				log.Println("generating thumb for: ", movieFile.Name())
+	var frame image.Image
 
-				if thumb, thumbErr := context.Thumbnail(); thumbErr == nil {
-					imgRelPath := filepath.Join(thumbsDirRel, filepath.Base(movieFile.Name())+".jpg")
-					imgAbsPath := filepath.Join(outDir, imgRelPath)
+	// use the selected poster-frame or a frame at the configured time, if possible
+	t := frameTime(movieDur)
+	extract := t > 0
 
-					if imgFile, err := os.Create(imgAbsPath); err == nil {
+	// a poster-frame might be the very first frame
+	if mov.PosterTime != nil {
+		t, extract = *mov.PosterTime, true
+	}
 
-						img := image.NewRGBA(image.Rect(0, 0, int(thumb.Width), int(thumb.Height)))
-						img.Pix = thumb.Data
+	if extract && mov.Type != MediaTypeImage {
+		if frame, err = extractFrame(ctx, mov.Path, t); err != nil {
+			logger.Warn("could not extract frame", "path", mov.Path, "error", err)
+		}
+	}
 
-						if encodeErr := jpeg.Encode(imgFile, img, nil); encodeErr != nil {
-							log.Println(encodeErr)
-						}
-						imgFile.Close()
-						log.Println("done ->", imgRelPath)
-
-						mov.IconPath = imgRelPath
-						mov.Duration = movieDur
-						thumbMutex.Lock()
-						IconMap[mov.Path] = imgRelPath
-						thumbMutex.Unlock()
-					} else {
-						log.Println("could not create file:", imgAbsPath)
-					}
+	if frame == nil {
+		thumb, thumbErr := context.Thumbnail()
 
-				} else {
-					log.Println("error:", thumbErr)
-				}
-				context.Close()
-				movieFile.Close()
-			} else {
-				log.Println("could not open movie file")
-			}
+		if thumbErr != nil {
+			logger.Warn("could not create thumbnail", "path", mov.Path, "error", thumbErr)
+			return thumbErr
 		}
+		img := image.NewRGBA(image.Rect(0, 0, int(thumb.Width), int(thumb.Height)))
+		img.Pix = thumb.Data
+		frame = img
 	}
-	movieMutex.RUnlock()
 
-	if dirtyThumbs {
-		if iconsFile, err := os.Create(thumbsFile); err == nil {
-			defer iconsFile.Close()
-
-			// encode playlist as json
-			thumbMutex.RLock()
-			enc := json.NewEncoder(iconsFile)
-			enc.SetIndent("", "  ")
-			enc.Encode(IconMap)
-			log.Println("icons JSON written to ", iconsFile.Name())
-			thumbMutex.RUnlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// write all configured sizes
+	imgRelPath, thumbs, encodeErr := writeThumbnailSizes(mov, frame, outDir, "")
+
+	if encodeErr != nil {
+		logger.Warn("could not write thumbnails", "path", mov.Path, "error", encodeErr)
+		return encodeErr
+	}
+	logger.Debug("thumbnail done", "path", mov.Path, "icon", imgRelPath)
+
+	// sprite-sheet for scrub-previews
+	sprite := mov.Sprite
+
+	if thumbSettings.Sprite.Enabled && mov.Type == MediaTypeVideo && movieDur > 0 {
+		if sprite, err = generateSprite(ctx, mov, movieDur, outDir); err != nil {
+			logger.Warn("could not create sprite-sheet", "path", mov.Path, "error", err)
+			sprite = mov.Sprite
 		}
+	}
+
+	movieMutex.Lock()
+	defer movieMutex.Unlock()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// a thumbnail uploaded meanwhile is kept
+	if shared.CustomIcon && shared.IconPath != mov.IconPath {
+		logger.Debug("custom thumbnail kept", "path", mov.Path)
+		return nil
+	}
+	shared.IconPath = imgRelPath
+	shared.Thumbs = thumbs
+	shared.Sprite = sprite
+	shared.CustomIcon = false
+
+	if shared.Type != MediaTypeImage {
+		shared.Duration = movieDur
+	}
+	thumbMutex.Lock()
+	IconMap[shared.Path] = imgRelPath
+	thumbMutex.Unlock()
+	return nil
+}
+
+// saveIconMap writes the IconMap to its json-file
+func saveIconMap() {
+	if iconsFile, err := os.Create(thumbsFile); err == nil {
+		defer iconsFile.Close()
 
-		// force re-init
-		Init(mediaDir)
+		// encode playlist as json
+		thumbMutex.RLock()
+		enc := json.NewEncoder(iconsFile)
+		enc.SetIndent("", "  ")
+		enc.Encode(IconMap)
+		logger.Debug("icons written", "file", iconsFile.Name())
+		thumbMutex.RUnlock()
 	}
 }
@@ -0,0 +1,372 @@
+package playlist
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// play-modes of playlists
+const (
+	PlayModeSequential = "sequential"
+	PlayModeShuffle    = "shuffle"
+	PlayModeWeighted   = "weighted"
+	PlayModeOnce       = "once"
+	PlayModeLoop       = "loop"
+)
+
+// PlayMode configures the play-order of a playlist
+type PlayMode struct {
+	Mode string `json:"mode"`
+
+	// Count is the number of passes for PlayModeLoop
+	Count int `json:"count,omitempty"`
+
+	// Weights of movies by path for PlayModeWeighted, missing weights default to 1
+	Weights map[string]float64 `json:"weights,omitempty"`
+}
+
+// actions resulting from a state-update, like the end of a pass through the play-order
+const (
+	orderContinue = iota
+	orderReorder
+	orderStop
+	orderResume
+	orderRestore
+	orderRemap
+)
+
+// validate checks the mode-name and its parameters
+func (mode *PlayMode) validate() error {
+	switch mode.Mode {
+	case "", PlayModeSequential, PlayModeShuffle, PlayModeWeighted, PlayModeOnce:
+	case PlayModeLoop:
+		if mode.Count < 1 {
+			return fmt.Errorf("invalid loop-count: %d", mode.Count)
+		}
+	default:
+		return fmt.Errorf("unknown play-mode: %s", mode.Mode)
+	}
+	return nil
+}
+
+// random returns true for modes that compute a new order for every pass
+func (mode PlayMode) random() bool {
+	return mode.Mode == PlayModeShuffle || mode.Mode == PlayModeWeighted
+}
+
+// passes returns the number of passes before playback stops, zero for endless playback
+func (mode PlayMode) passes() int {
+	switch mode.Mode {
+	case PlayModeOnce:
+		return 1
+	case PlayModeLoop:
+		return mode.Count
+	}
+	return 0
+}
+
+// playMode returns the playlist's play-mode, defaults to sequential playback.
+// requires a locked movieMutex or playlistMutex
+func (list *Playlist) playMode() PlayMode {
+	if list.Mode == nil || list.Mode.Mode == "" {
+		return PlayMode{Mode: PlayModeSequential}
+	}
+	return *list.Mode
+}
+
+// playableIndices returns the indices of all available movies of a playlist.
+// requires a locked movieMutex
+func (list *Playlist) playableIndices() []int {
+	indices := []int{}
+
+	for i, entry := range list.Movies {
+		if !entry.Missing {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// order computes the play-order for a single pass, as indices into the playlist.
+// random modes start with first, if it is a playable index, and avoid starting with avoid,
+// so items are not repeated across passes. requires a locked movieMutex
+func (mode PlayMode) order(list *Playlist, first, avoid int) []int {
+	indices := list.playableIndices()
+
+	switch mode.Mode {
+	case PlayModeShuffle:
+		rand.Shuffle(len(indices), func(i, j int) { indices[i], indices[j] = indices[j], indices[i] })
+
+	case PlayModeWeighted:
+		indices = mode.weightedDraws(list, indices)
+
+	default:
+		return list.expandLoops(indices)
+	}
+
+	if len(indices) < 2 {
+		return list.expandLoops(indices)
+	}
+	placed := false
+
+	for i, index := range indices {
+		if index == first {
+			indices[0], indices[i] = indices[i], indices[0]
+			placed = true
+			break
+		}
+	}
+
+	if !placed && indices[0] == avoid {
+		swap := 1 + rand.Intn(len(indices)-1)
+		indices[0], indices[swap] = indices[swap], indices[0]
+	}
+	return list.expandLoops(indices)
+}
+
+// expandLoops repeats the indices of looped entries, so they are played consecutively.
+// requires a locked movieMutex
+func (list *Playlist) expandLoops(indices []int) []int {
+	order := make([]int, 0, len(indices))
+
+	for _, index := range indices {
+		for i := 0; i < list.Movies[index].loops(); i++ {
+			order = append(order, index)
+		}
+	}
+	return order
+}
+
+// weightedDraws draws as many items as provided, with replacement and proportional to their weights.
+// direct repetitions are avoided, if possible. requires a locked movieMutex
+func (mode PlayMode) weightedDraws(list *Playlist, indices []int) []int {
+	weights := make([]float64, len(indices))
+	var total float64
+
+	for i, index := range indices {
+		weights[i] = 1
+
+		if w, ok := mode.Weights[list.Movies[index].Path]; ok {
+			weights[i] = w
+		}
+
+		if weights[i] < 0 {
+			weights[i] = 0
+		}
+		total += weights[i]
+	}
+
+	// nothing to weigh, fall back to uniform draws
+	if total <= 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = float64(len(weights))
+	}
+
+	draw := func() int {
+		r := rand.Float64() * total
+
+		for i, w := range weights {
+			if r < w {
+				return indices[i]
+			}
+			r -= w
+		}
+		return indices[len(indices)-1]
+	}
+	draws := make([]int, 0, len(indices))
+
+	for len(draws) < len(indices) {
+		index := draw()
+
+		// a few retries to avoid direct repetitions
+		for retry := 0; retry < 8 && len(draws) > 0 && index == draws[len(draws)-1]; retry++ {
+			index = draw()
+		}
+		draws = append(draws, index)
+	}
+	return draws
+}
+
+// splicedOrder is a play-order, sent to the player, mapped onto the changed movies of its playlist
+type splicedOrder struct {
+	order       []int
+	entries     []*PlaylistEntry
+	playerIndex int
+
+	// changed is false, if the player plays the same items. the order then only holds the new indices
+	changed bool
+
+	// removed is true, if the current item is no longer part of the playlist
+	removed bool
+}
+
+// splice maps a play-order, sent to the player, onto the changed movies of a playlist by their paths.
+// sequential modes follow the playlist's new sequence, random modes keep the order of the remaining items.
+// shuffled playlists get added movies at random places after the current item, weighted playlists draw them
+// with the next pass. inserted items are kept. requires a locked movieMutex
+func (mode PlayMode) splice(list *Playlist, order []int, entries []*PlaylistEntry, playerIndex int) *splicedOrder {
+	// playable indices by path, duplicates in the order of the playlist
+	indices := make(map[string][]int)
+
+	for _, index := range list.playableIndices() {
+		path := list.Movies[index].Path
+		indices[path] = append(indices[path], index)
+	}
+
+	// map the remaining items to their new indices, the current item is followed by the next remaining one
+	spliced := &splicedOrder{playerIndex: -1, removed: true}
+	sent := make(map[string]bool)
+
+	for i, index := range order {
+		entry := entries[i]
+
+		if index >= 0 {
+			sent[entry.Path] = true
+			candidates := indices[entry.Path]
+
+			if len(candidates) == 0 {
+				spliced.changed = true
+				continue
+			}
+			newIndex := candidates[0]
+
+			for _, candidate := range candidates {
+				if candidate == index {
+					newIndex = index
+				}
+			}
+			index = newIndex
+			entry = list.Movies[index]
+		}
+
+		if i >= playerIndex && spliced.playerIndex < 0 {
+			spliced.playerIndex = len(spliced.order)
+			spliced.removed = i != playerIndex
+		}
+		spliced.order = append(spliced.order, index)
+		spliced.entries = append(spliced.entries, entry)
+	}
+
+	if spliced.playerIndex < 0 {
+		spliced.playerIndex = 0
+	}
+
+	switch {
+	case !mode.random():
+		// the playlist's sequence, continued at the current or next remaining item
+		sequence := mode.order(list, -1, -1)
+		same := !spliced.changed
+		j := 0
+
+		for _, index := range spliced.order {
+			if index < 0 {
+				continue
+			}
+
+			if j >= len(sequence) || sequence[j] != index {
+				same = false
+				break
+			}
+			j++
+		}
+
+		if same && j == len(sequence) {
+			break
+		}
+		// inserted items stay around the current or next remaining item
+		rest := spliced.order[spliced.playerIndex:]
+		restEntries := spliced.entries[spliced.playerIndex:]
+		first := 0
+
+		for first < len(rest) && rest[first] < 0 {
+			first++
+		}
+		last := first + 1
+
+		for last < len(rest) && rest[last] < 0 {
+			last++
+		}
+		pos := -1
+
+		if first < len(rest) {
+			for i, index := range sequence {
+				if index == rest[first] {
+					pos = i
+					break
+				}
+			}
+		}
+		newOrder := make([]int, 0, len(sequence)+len(rest))
+		newEntries := make([]*PlaylistEntry, 0, len(sequence)+len(rest))
+		appendSequence := func(indices []int) {
+			for _, index := range indices {
+				newOrder = append(newOrder, index)
+				newEntries = append(newEntries, list.Movies[index])
+			}
+		}
+
+		if pos < 0 {
+			newOrder = append(newOrder, rest[:first]...)
+			newEntries = append(newEntries, restEntries[:first]...)
+			appendSequence(sequence)
+			pos = 0
+		} else {
+			appendSequence(sequence[:pos])
+			newOrder = append(newOrder, rest[:last]...)
+			newEntries = append(newEntries, restEntries[:last]...)
+			appendSequence(sequence[pos+1:])
+		}
+		spliced.order = newOrder
+		spliced.entries = newEntries
+		spliced.playerIndex = pos
+		spliced.changed = true
+
+	case mode.Mode == PlayModeShuffle:
+		// added movies are played later in the current pass
+		for _, index := range list.playableIndices() {
+			entry := list.Movies[index]
+
+			if sent[entry.Path] {
+				continue
+			}
+			sent[entry.Path] = true
+			pos := spliced.playerIndex + 1
+
+			if pos > len(spliced.order) {
+				pos = len(spliced.order)
+			}
+			pos += rand.Intn(len(spliced.order) - pos + 1)
+
+			for loop := 0; loop < entry.loops(); loop++ {
+				spliced.order = append(spliced.order[:pos], append([]int{index}, spliced.order[pos:]...)...)
+				spliced.entries = append(spliced.entries[:pos],
+					append([]*PlaylistEntry{entry}, spliced.entries[pos:]...)...)
+			}
+			spliced.changed = true
+		}
+	}
+	return spliced
+}
+
+// SetPlayMode sets the play-mode of the playlist with the provided index.
+// the mode takes effect with the next playback of the playlist.
+// modes of "All ..." playlists are kept in memory only
+func SetPlayMode(playlistIndex int, mode *PlayMode) error {
+	if mode != nil {
+		if err := mode.validate(); err != nil {
+			return err
+		}
+	}
+	movieMutex.Lock()
+	defer movieMutex.Unlock()
+	playlistMutex.Lock()
+	defer playlistMutex.Unlock()
+
+	if playlistIndex < 0 || playlistIndex >= len(playlists) {
+		return fmt.Errorf("playlist-index out of range: %d", playlistIndex)
+	}
+	playlists[playlistIndex].Mode = mode
+	return nil
+}
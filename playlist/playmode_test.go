@@ -0,0 +1,98 @@
+package playlist
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPlaylist creates a playlist of the provided paths, paths starting with '!' are missing
+func testPlaylist(paths ...string) *Playlist {
+	list := &Playlist{}
+
+	for _, p := range paths {
+		mov := &Movie{Path: strings.TrimPrefix(p, "!"), Missing: strings.HasPrefix(p, "!")}
+		list.Movies = append(list.Movies, newEntry(mov))
+	}
+	return list
+}
+
+func TestSplice(t *testing.T) {
+	clip := newEntry(&Movie{Path: "clip"})
+
+	tests := []struct {
+		name        string
+		mode        string
+		old         []string
+		order       []int
+		playerIndex int
+		new         []string
+
+		// accepted orders, by path
+		want        [][]string
+		wantIndex   int
+		wantChanged bool
+		wantRemoved bool
+	}{
+		{"sequential, indices shifted", PlayModeSequential, []string{"b", "c"}, []int{0, 1}, 1,
+			[]string{"!a", "b", "c"}, [][]string{{"b", "c"}}, 1, false, false},
+		{"sequential, added", PlayModeSequential, []string{"a", "c"}, []int{0, 1}, 1,
+			[]string{"a", "b", "c"}, [][]string{{"a", "b", "c"}}, 2, true, false},
+		{"sequential, current removed", PlayModeSequential, []string{"a", "b", "c"}, []int{0, 1, 2}, 1,
+			[]string{"a", "c"}, [][]string{{"a", "c"}}, 1, true, true},
+		{"sequential, reordered", PlayModeSequential, []string{"a", "b", "c"}, []int{0, 1, 2}, 0,
+			[]string{"c", "a", "b"}, [][]string{{"c", "a", "b"}}, 1, true, false},
+		{"sequential, inserted kept", PlayModeSequential, []string{"a", "b"}, []int{0, -1, 1}, 0,
+			[]string{"a", "b", "c"}, [][]string{{"a", "clip", "b", "c"}}, 0, true, false},
+		{"shuffle, reordered", PlayModeShuffle, []string{"a", "b", "c"}, []int{2, 0, 1}, 1,
+			[]string{"c", "b", "a"}, [][]string{{"c", "a", "b"}}, 1, false, false},
+		{"shuffle, removed", PlayModeShuffle, []string{"a", "b", "c", "d"}, []int{3, 1, 0, 2}, 2,
+			[]string{"a", "c", "d"}, [][]string{{"d", "a", "c"}}, 1, true, false},
+		{"shuffle, added", PlayModeShuffle, []string{"a", "b"}, []int{1, 0}, 0,
+			[]string{"a", "b", "c"}, [][]string{{"b", "c", "a"}, {"b", "a", "c"}}, 0, true, false},
+		{"weighted, added", PlayModeWeighted, []string{"a", "b"}, []int{0, 0, 1}, 1,
+			[]string{"a", "b", "c"}, [][]string{{"a", "a", "b"}}, 1, false, false},
+		{"weighted, last removed", PlayModeWeighted, []string{"a", "b"}, []int{0, 1}, 1,
+			[]string{"a"}, [][]string{{"a"}}, 0, true, true},
+	}
+
+	for _, test := range tests {
+		old := testPlaylist(test.old...)
+		entries := make([]*PlaylistEntry, len(test.order))
+
+		for i, index := range test.order {
+			if entries[i] = clip; index >= 0 {
+				entries[i] = old.Movies[index]
+			}
+		}
+		list := testPlaylist(test.new...)
+		spliced := PlayMode{Mode: test.mode}.splice(list, test.order, entries, test.playerIndex)
+
+		var paths []string
+
+		for i, entry := range spliced.entries {
+			paths = append(paths, entry.Path)
+
+			// indices refer to the new playlist
+			if index := spliced.order[i]; index >= 0 && list.Movies[index] != entry {
+				t.Errorf("%s: index %d does not match entry %s", test.name, index, entry.Path)
+			}
+		}
+		accepted := false
+
+		for _, want := range test.want {
+			accepted = accepted || reflect.DeepEqual(paths, want)
+		}
+
+		if !accepted {
+			t.Errorf("%s: got %v, want one of %v", test.name, paths, test.want)
+		}
+
+		if spliced.playerIndex != test.wantIndex || spliced.changed != test.wantChanged ||
+			spliced.removed != test.wantRemoved {
+			t.Errorf("%s: got index %d, changed %v, removed %v, want %d, %v, %v", test.name,
+				spliced.playerIndex, spliced.changed, spliced.removed,
+				test.wantIndex, test.wantChanged, test.wantRemoved)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package playlist
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	// gif-support for custom thumbnails, jpeg and png are used for frames already
+	_ "image/gif"
+)
+
+// SetCustomThumbnail replaces the thumbnails of a movie with an uploaded image.
+// custom thumbnails are kept until the thumbnail is regenerated or the movie-file changes
+func SetCustomThumbnail(path string, data io.Reader, outDir string) (*Movie, error) {
+	mov := GetMovie(path)
+
+	if mov == nil {
+		return nil, os.ErrNotExist
+	}
+	img, format, err := image.Decode(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+
+	// pending jobs would overwrite the custom thumbnail
+	if thumbnails != nil {
+		thumbnails.Cancel([]string{path})
+	}
+	thumbsDirAbs := filepath.Join(outDir, thumbsDirRel)
+
+	if err := os.MkdirAll(thumbsDirAbs, os.ModePerm); err != nil {
+		return nil, err
+	}
+	// every upload gets new file-names, browsers would show a cached former upload otherwise
+	version := strconv.FormatInt(time.Now().UnixNano(), 36)
+	iconPath, thumbs, err := writeThumbnailSizes(mov, img, outDir, version)
+
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("custom thumbnail", "path", path, "icon", iconPath, "format", format)
+
+	movieMutex.Lock()
+	mov.IconPath = iconPath
+	mov.Thumbs = thumbs
+	mov.PosterTime = nil
+	mov.CustomIcon = true
+	movieMutex.Unlock()
+
+	thumbMutex.Lock()
+	IconMap[path] = iconPath
+	thumbMutex.Unlock()
+	saveIconMap()
+
+	sendThumbnailProgress(&ThumbnailProgress{Path: path, IconPath: iconPath, State: JobDone})
+	return mov, nil
+}
+
+// SetPosterFrame selects the frame at the provided time as thumbnail for a movie
+// and regenerates its thumbnails in background
+func SetPosterFrame(path string, seconds float64) (*Movie, error) {
+	mov := GetMovie(path)
+
+	if mov == nil {
+		return nil, os.ErrNotExist
+	}
+
+	movieMutex.Lock()
+	if mov.Type == MediaTypeImage {
+		movieMutex.Unlock()
+		return nil, fmt.Errorf("no poster-frames for still images")
+	}
+
+	if seconds < 0 || (mov.Duration > 0 && seconds > mov.Duration) {
+		movieMutex.Unlock()
+		return nil, fmt.Errorf("poster-frame out of range: %.3f", seconds)
+	}
+	mov.PosterTime = &seconds
+	movieMutex.Unlock()
+
+	return mov, regenerate(mov)
+}
+
+// RegenerateThumbnail drops a custom thumbnail or poster-frame of a movie
+// and regenerates its thumbnails in background, using the thumbnail-settings
+func RegenerateThumbnail(path string) (*Movie, error) {
+	mov := GetMovie(path)
+
+	if mov == nil {
+		return nil, os.ErrNotExist
+	}
+	movieMutex.Lock()
+	mov.PosterTime = nil
+	movieMutex.Unlock()
+
+	return mov, regenerate(mov)
+}
+
+// regenerate restarts the thumbnail-generation for a movie with visible priority
+func regenerate(mov *Movie) error {
+	movieMutex.RLock()
+	missing, path := mov.Missing, mov.Path
+	movieMutex.RUnlock()
+
+	if missing {
+		return fmt.Errorf("movie-file missing: %s", path)
+	}
+
+	if thumbnails == nil {
+		return fmt.Errorf("no thumbnail-pipeline running")
+	}
+	thumbnails.Restart(mov, PriorityVisible)
+	return nil
+}
@@ -0,0 +1,245 @@
+package playlist
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+)
+
+// PreviewSettings configures the lower-bitrate proxies used for previews in the web-ui
+type PreviewSettings struct {
+	// Enabled starts proxy-generation in background, otherwise previews use the original files
+	Enabled bool `json:"enabled"`
+
+	// Height of the proxies in pixels, videos with a lower height are not proxied
+	Height int `json:"height"`
+
+	VideoBitRate string `json:"video_bit_rate"`
+	AudioBitRate string `json:"audio_bit_rate"`
+
+	// Dir is the directory holding the generated proxies
+	Dir string `json:"dir"`
+}
+
+// previewSettings holds the active preview-settings
+var previewSettings = PreviewSettings{
+	Enabled:      false,
+	Height:       480,
+	VideoBitRate: "1M",
+	AudioBitRate: "96k",
+	Dir:          "previews",
+}
+
+var previewSettingsFile = "previewSettings.json"
+
+// movies waiting for proxy-generation, processed by a single worker to keep the load low
+var previewQueue = make(chan *Movie, 4096)
+var previewPending = make(map[string]bool)
+var previewMutex sync.Mutex
+
+// LoadPreviewSettings reads the preview-settings from their json-file, if present.
+// settings missing in the file keep their defaults
+func LoadPreviewSettings() PreviewSettings {
+	if err := jsonfile.Load(previewSettingsFile, &previewSettings); err != nil {
+		logger.Error("could not parse preview-settings", "error", err)
+	}
+	return previewSettings
+}
+
+// PreviewFile validates a preview-request and returns the file to serve.
+// only files of known, available movies inside a media-root are served.
+// if proxy is true and a proxy is ready, its path is returned, otherwise the proxy is enqueued
+func PreviewFile(path string, proxy bool) (string, error) {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return "", os.ErrNotExist
+	}
+	mov := GetMovie(path)
+
+	if mov == nil || mov.Missing {
+		return "", os.ErrNotExist
+	}
+
+	if rootForPath(path) == nil {
+		return "", os.ErrPermission
+	}
+
+	if proxy && needsProxy(mov) {
+		if proxyReady(mov) {
+			return proxyPath(mov), nil
+		}
+		enqueuePreview(mov)
+	}
+	return path, nil
+}
+
+// StartPreviewGeneration starts the proxy-worker and enqueues all videos without proxy
+func StartPreviewGeneration() {
+	if !previewSettings.Enabled {
+		return
+	}
+	go previewWorker()
+
+	var todo []*Movie
+
+	movieMutex.RLock()
+	for _, mov := range movieMap {
+		if needsProxy(mov) && !proxyReady(mov) {
+			todo = append(todo, mov)
+		}
+	}
+	movieMutex.RUnlock()
+
+	logger.Info("missing preview-proxies", "movies", len(todo))
+
+	for _, mov := range todo {
+		enqueuePreview(mov)
+	}
+}
+
+// needsProxy returns true for available videos, exceeding the proxy-height
+func needsProxy(mov *Movie) bool {
+	if !previewSettings.Enabled || mov.Missing || mov.Type != MediaTypeVideo {
+		return false
+	}
+	return mov.Info == nil || mov.Info.Height > previewSettings.Height
+}
+
+// proxyPath returns the path of a movie's proxy-file
+func proxyPath(mov *Movie) string {
+	return filepath.Join(previewSettings.Dir, thumbKey(mov)+".mp4")
+}
+
+// proxyReady returns true, if a proxy exists that is newer than its movie-file
+func proxyReady(mov *Movie) bool {
+	proxyInfo, err := os.Stat(proxyPath(mov))
+
+	if err != nil {
+		return false
+	}
+	movieInfo, err := os.Stat(mov.Path)
+	return err == nil && proxyInfo.ModTime().After(movieInfo.ModTime())
+}
+
+// enqueuePreview adds a movie to the preview-queue, unless it is already pending
+func enqueuePreview(mov *Movie) {
+	previewMutex.Lock()
+	defer previewMutex.Unlock()
+
+	if previewPending[mov.Path] {
+		return
+	}
+
+	select {
+	case previewQueue <- mov:
+		previewPending[mov.Path] = true
+	default:
+		// queue full, the proxy is enqueued again on its next request
+		metrics.DroppedEvents.Inc("preview")
+	}
+}
+
+func previewWorker() {
+	for mov := range previewQueue {
+		if err := generatePreview(mov); err != nil {
+			logger.Warn("could not create preview", "path", mov.Path, "error", err)
+		}
+		previewMutex.Lock()
+		delete(previewPending, mov.Path)
+		previewMutex.Unlock()
+	}
+}
+
+// generatePreview transcodes a movie to a lower-bitrate proxy, using ffmpeg.
+// the proxy is written to a temporary file first, so partial files are never served
+func generatePreview(mov *Movie) error {
+	if !needsProxy(mov) || proxyReady(mov) {
+		return nil
+	}
+
+	if err := os.MkdirAll(previewSettings.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	outPath := proxyPath(mov)
+	tmpPath := outPath + ".part"
+	logger.Debug("generating preview", "path", mov.Path)
+
+	cmd := exec.Command(FFMpegPath, "-v", "error", "-i", mov.Path,
+		"-vf", fmt.Sprintf("scale=-2:%d", previewSettings.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-b:v", previewSettings.VideoBitRate,
+		"-c:a", "aac", "-b:a", previewSettings.AudioBitRate,
+		"-movflags", "+faststart", "-f", "mp4", "-y", tmpPath)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	logger.Debug("preview done", "path", mov.Path, "proxy", outPath)
+	return os.Rename(tmpPath, outPath)
+}
+
+// isProxyName returns true for the file-names of proxies and their temporary files,
+// i.e. '<key>.mp4' and '<key>.mp4.part'
+func isProxyName(name string) bool {
+	name = strings.TrimSuffix(name, ".part")
+
+	if !strings.HasSuffix(name, ".mp4") || len(name) != 16+len(".mp4") {
+		return false
+	}
+	_, err := hex.DecodeString(strings.TrimSuffix(name, ".mp4"))
+	return err == nil
+}
+
+// CollectPreviewGarbage removes all proxies, which do not belong to a known movie.
+// other files in the preview-directory are kept, nothing is removed while previews are disabled.
+// return: the paths of all removed files
+func CollectPreviewGarbage() []string {
+	if !previewSettings.Enabled {
+		return nil
+	}
+	entries, err := os.ReadDir(previewSettings.Dir)
+
+	if err != nil {
+		return nil
+	}
+	used := make(map[string]bool)
+
+	movieMutex.RLock()
+	for _, mov := range movieMap {
+		used[filepath.Base(proxyPath(mov))] = true
+	}
+	movieMutex.RUnlock()
+
+	previewMutex.Lock()
+	busy := len(previewPending) > 0
+	previewMutex.Unlock()
+
+	removed := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// temporary files might belong to a running transcode
+		if entry.IsDir() || !isProxyName(name) || used[name] || (busy && strings.HasSuffix(name, ".part")) {
+			continue
+		}
+		p := filepath.Join(previewSettings.Dir, name)
+
+		if err := os.Remove(p); err != nil {
+			logger.Warn("could not remove preview", "error", err)
+			continue
+		}
+		removed = append(removed, p)
+	}
+
+	if len(removed) > 0 {
+		logger.Info("removed unused previews", "files", len(removed))
+	}
+	return removed
+}
@@ -0,0 +1,231 @@
+package playlist
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakape/thumbnailer"
+)
+
+// MediaInfo groups technical metadata of a media-file
+type MediaInfo struct {
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	FrameRate   float64      `json:"frame_rate"`
+	VideoCodec  string       `json:"video_codec"`
+	AudioTracks []AudioTrack `json:"audio_tracks"`
+	Duration    float64      `json:"duration"`
+	BitRate     int64        `json:"bit_rate"`
+	Size        int64        `json:"size"`
+	ModTime     time.Time    `json:"mod_time"`
+}
+
+// AudioTrack groups information about a single audio-stream
+type AudioTrack struct {
+	Index      int    `json:"index"`
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels"`
+	SampleRate int    `json:"sample_rate"`
+	Language   string `json:"language"`
+	Title      string `json:"title"`
+}
+
+// FFProbePath is the ffprobe executable used for metadata extraction.
+// if it is not available, a reduced set of metadata is read using the ffmpeg-context
+var FFProbePath = "ffprobe"
+
+// isStale returns true if the provided file-info does not match the probed metadata
+func (info *MediaInfo) isStale(fileInfo os.FileInfo) bool {
+	return info == nil || info.Size != fileInfo.Size() || !info.ModTime.Equal(fileInfo.ModTime())
+}
+
+// probe refreshes the movie's metadata, if the file changed since it was last probed.
+// the file is probed without holding the movieMutex, which must not be locked by the caller.
+// return: true, if the metadata was updated
+func (mov *Movie) probe(force bool) (bool, error) {
+	movieMutex.RLock()
+	path, current := mov.Path, mov.Info
+	movieMutex.RUnlock()
+
+	fileInfo, err := os.Stat(path)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !force && !current.isStale(fileInfo) {
+		return false, nil
+	}
+	info, err := ProbeFile(path)
+
+	if err != nil {
+		return false, err
+	}
+	movieMutex.Lock()
+	defer movieMutex.Unlock()
+	mov.Info = info
+
+	// still images keep their display-duration
+	if mov.Type != MediaTypeImage && info.Duration > 0 {
+		mov.Duration = info.Duration
+	}
+	return true, nil
+}
+
+// ProbeFile extracts technical metadata from the provided media-file
+func ProbeFile(path string) (*MediaInfo, error) {
+	fileInfo, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+	info, err := probeFFProbe(path)
+
+	if err != nil {
+		// fallback, if ffprobe is not available
+		if info, err = probeFFContext(path); err != nil {
+			return nil, err
+		}
+	}
+	info.Size = fileInfo.Size()
+	info.ModTime = fileInfo.ModTime()
+	return info, nil
+}
+
+// probeFFProbe runs ffprobe on the provided file and parses its json-output
+func probeFFProbe(path string) (*MediaInfo, error) {
+	out, err := exec.Command(FFProbePath, "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", path).Output()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			Index        int               `json:"index"`
+			CodecType    string            `json:"codec_type"`
+			CodecName    string            `json:"codec_name"`
+			Width        int               `json:"width"`
+			Height       int               `json:"height"`
+			AvgFrameRate string            `json:"avg_frame_rate"`
+			Channels     int               `json:"channels"`
+			SampleRate   string            `json:"sample_rate"`
+			Tags         map[string]string `json:"tags"`
+			Disposition  map[string]int    `json:"disposition"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+	}
+
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+	info := &MediaInfo{AudioTracks: []AudioTrack{}}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// skip embedded cover-art and additional video-streams
+			if info.VideoCodec != "" || stream.Disposition["attached_pic"] == 1 {
+				continue
+			}
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+
+		case "audio":
+			sampleRate, _ := strconv.Atoi(stream.SampleRate)
+			info.AudioTracks = append(info.AudioTracks, AudioTrack{
+				Index:      stream.Index,
+				Codec:      stream.CodecName,
+				Channels:   stream.Channels,
+				SampleRate: sampleRate,
+				Language:   stream.Tags["language"],
+				Title:      stream.Tags["title"],
+			})
+		}
+	}
+	return info, nil
+}
+
+// parseFrameRate parses frame-rates like "30000/1001" or "25"
+func parseFrameRate(rate string) float64 {
+	parts := strings.SplitN(rate, "/", 2)
+	num, err := strconv.ParseFloat(parts[0], 64)
+
+	if err != nil {
+		return 0
+	}
+
+	if len(parts) == 2 {
+		if den, err := strconv.ParseFloat(parts[1], 64); err == nil && den != 0 {
+			return num / den
+		}
+		return 0
+	}
+	return num
+}
+
+// probeFFContext reads duration, dimensions and codecs using the ffmpeg-context
+func probeFFContext(path string) (*MediaInfo, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	context, err := thumbnailer.NewFFContext(file)
+
+	if err != nil {
+		return nil, err
+	}
+	defer context.Close()
+
+	info := &MediaInfo{AudioTracks: []AudioTrack{}}
+	info.Duration = context.Duration().Seconds()
+
+	if hasVideo, _ := context.HasStream(thumbnailer.FFVideo); hasVideo {
+		info.VideoCodec, _ = context.CodecName(thumbnailer.FFVideo)
+
+		if dims, err := context.Dims(); err == nil {
+			info.Width = int(dims.Width)
+			info.Height = int(dims.Height)
+		}
+	}
+
+	if hasAudio, _ := context.HasStream(thumbnailer.FFAudio); hasAudio {
+		codec, _ := context.CodecName(thumbnailer.FFAudio)
+		info.AudioTracks = append(info.AudioTracks, AudioTrack{Codec: codec})
+	}
+	return info, nil
+}
+
+// GetMovie looks up a movie by path and returns it or nil, if not found
+func GetMovie(path string) *Movie {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+	return movieMap[path]
+}
+
+// ProbeMovie refreshes the metadata of the movie with the provided path.
+// if force is false, the file is only probed if it changed since it was last probed
+func ProbeMovie(path string, force bool) (*Movie, error) {
+	mov := GetMovie(path)
+
+	if mov == nil {
+		return nil, os.ErrNotExist
+	}
+	_, err := mov.probe(force)
+	return mov, err
+}
@@ -0,0 +1,138 @@
+package playlist
+
+import (
+	"errors"
+	"fmt"
+)
+
+// resumePoint holds the playback interrupted by a clip
+type resumePoint struct {
+	playlistIndex int
+	order         []int
+	entries       []*PlaylistEntry
+	playerIndex   int
+
+	// position inside the whole movie
+	position float64
+}
+
+// queueEntry returns an entry for an available movie of the library
+func queueEntry(path string) (*PlaylistEntry, error) {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	mov, ok := movieMap[path]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown movie: %s", path)
+	}
+
+	if mov.Missing {
+		return nil, fmt.Errorf("movie not available: %s", path)
+	}
+	return newEntry(mov), nil
+}
+
+// hasInserted returns true if a play-order contains inserted items
+func hasInserted(order []int) bool {
+	for _, index := range order {
+		if index < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// insertNext inserts an entry after the item at playerIndex and all items already inserted after it.
+// returns copies of order and entries
+func insertNext(order []int, entries []*PlaylistEntry, playerIndex int, entry *PlaylistEntry) ([]int, []*PlaylistEntry) {
+	pos := playerIndex + 1
+
+	for pos < len(order) && order[pos] < 0 {
+		pos++
+	}
+	newOrder := make([]int, 0, len(order)+1)
+	newOrder = append(append(append(newOrder, order[:pos]...), -1), order[pos:]...)
+
+	newEntries := make([]*PlaylistEntry, 0, len(entries)+1)
+	newEntries = append(append(append(newEntries, entries[:pos]...), entry), entries[pos:]...)
+	return newOrder, newEntries
+}
+
+// Enqueue plays the movie with the provided path after the current item, without changing the playlist.
+// queued movies play in the order they were enqueued and are removed after the current pass.
+// the player continues the current item at its position, while an interrupting clip plays,
+// the movie is queued in the interrupted playback
+func (updater *PlaybackStateUpdater) Enqueue(path, requestID string) error {
+	entry, err := queueEntry(path)
+
+	if err != nil {
+		return err
+	}
+	updater.stateMutex.Lock()
+
+	if resume := updater.resume; resume != nil {
+		resume.order, resume.entries = insertNext(resume.order, resume.entries, resume.playerIndex, entry)
+		updater.stateMutex.Unlock()
+		return nil
+	}
+
+	if len(updater.playerIndices) == 0 {
+		updater.stateMutex.Unlock()
+		return errors.New("no active playback")
+	}
+	playlistIndex := updater.state.PlaylistIndex
+	playerIndex := updater.state.OrderPosition
+	position := updater.state.MoviePosition
+	order, entries := insertNext(updater.playerIndices, updater.playerEntries, playerIndex, entry)
+	updater.stateMutex.Unlock()
+
+	logger.Info("play next", "path", path)
+	updater.transmit(getPlaylist(playlistIndex), playlistIndex, order, entries, playerIndex, position, requestID)
+	return nil
+}
+
+// Interrupt plays the movie with the provided path immediately and resumes the interrupted playback
+// at its previous item and position, once the clip ended. nested interrupts resume the original playback
+func (updater *PlaybackStateUpdater) Interrupt(path, requestID string) error {
+	entry, err := queueEntry(path)
+
+	if err != nil {
+		return err
+	}
+	updater.stateMutex.Lock()
+
+	if updater.resume == nil && len(updater.playerIndices) > 0 {
+		updater.resume = &resumePoint{
+			playlistIndex: updater.state.PlaylistIndex,
+			order:         updater.playerIndices,
+			entries:       updater.playerEntries,
+			playerIndex:   updater.state.OrderPosition,
+			position:      updater.state.MoviePosition,
+		}
+	}
+	updater.state.Interrupted = updater.resume != nil
+	playlistIndex := updater.state.PlaylistIndex
+	updater.stateMutex.Unlock()
+
+	logger.Info("interrupt", "path", path)
+	updater.transmit(getPlaylist(playlistIndex), playlistIndex, []int{-1}, []*PlaylistEntry{entry}, 0, 0,
+		requestID)
+	return nil
+}
+
+// Resume ends an interrupting clip and continues the interrupted playback
+func (updater *PlaybackStateUpdater) Resume(requestID string) {
+	updater.stateMutex.Lock()
+	resume := updater.resume
+	updater.resume = nil
+	updater.state.Interrupted = false
+	updater.stateMutex.Unlock()
+
+	if resume == nil {
+		return
+	}
+	logger.Info("resume playback", "item", resume.playerIndex, "position", resume.position)
+	updater.transmit(getPlaylist(resume.playlistIndex), resume.playlistIndex, resume.order, resume.entries,
+		resume.playerIndex, resume.position, requestID)
+}
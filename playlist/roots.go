@@ -0,0 +1,261 @@
+package playlist
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+)
+
+// MediaRoot describes a media-directory and its scan-settings.
+// each root is presented as its own synthesized "All <Name>" playlist
+type MediaRoot struct {
+	Name       string   `json:"name"`
+	Path       string   `json:"path"`
+	Extensions []string `json:"extensions"`
+	Recursive  bool     `json:"recursive"`
+	Exclude    []string `json:"exclude"`
+}
+
+// mediaRoots holds all configured media-roots, in playlist-order.
+// published roots are never modified, but replaced holding the rootsMutex
+var mediaRoots []*MediaRoot
+
+var rootsMutex sync.RWMutex
+
+var mediaRootsFile = "mediaRoots.json"
+
+// LoadMediaRoots reads the media-roots from their json-file.
+// if no roots are configured, a single recursive root "Movies" is created for defaultDir
+func LoadMediaRoots(defaultDir string) []*MediaRoot {
+	var roots []*MediaRoot
+
+	if err := jsonfile.Load(mediaRootsFile, &roots); err != nil {
+		logger.Error("could not parse media-roots", "error", err)
+	}
+
+	if len(roots) == 0 {
+		roots = []*MediaRoot{{Name: "Movies", Path: defaultDir, Recursive: true}}
+	}
+
+	for _, root := range roots {
+		root.Path = filepath.Clean(root.Path)
+		logger.Info("media-root", "name", root.Name, "path", root.Path)
+	}
+	rootsMutex.Lock()
+	mediaRoots = roots
+	rootsMutex.Unlock()
+	return getMediaRoots()
+}
+
+// saveMediaRoots writes the media-roots to their json-file
+func saveMediaRoots() error {
+	jsonFile, err := os.Create(mediaRootsFile)
+
+	if err != nil {
+		return err
+	}
+	defer jsonFile.Close()
+
+	enc := json.NewEncoder(jsonFile)
+	enc.SetIndent("", "  ")
+	return enc.Encode(getMediaRoots())
+}
+
+// getMediaRoots returns a copy of the media-roots
+func getMediaRoots() []*MediaRoot {
+	rootsMutex.RLock()
+	defer rootsMutex.RUnlock()
+	return append([]*MediaRoot{}, mediaRoots...)
+}
+
+// GetMediaRoots returns all configured media-roots.
+// the returned roots must not be modified
+func GetMediaRoots() []*MediaRoot {
+	return getMediaRoots()
+}
+
+// GetMediaRoot returns the media-root with the provided name or nil, if not found
+func GetMediaRoot(name string) *MediaRoot {
+	for _, root := range getMediaRoots() {
+		if root.Name == name {
+			return root
+		}
+	}
+	return nil
+}
+
+// SelectMediaRoots returns the media-root with the provided name
+// or all media-roots, if name is empty
+func SelectMediaRoots(name string) []*MediaRoot {
+	if name == "" {
+		return getMediaRoots()
+	}
+
+	if root := GetMediaRoot(name); root != nil {
+		return []*MediaRoot{root}
+	}
+	return nil
+}
+
+// Contains returns true if the provided path equals the root-directory or is located below it
+func (root *MediaRoot) Contains(path string) bool {
+	rel, err := filepath.Rel(root.Path, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Title returns the title of the synthesized playlist for this root
+func (root *MediaRoot) Title() string {
+	return "All " + root.Name
+}
+
+// accepts returns true if the provided file-path matches the root's scan-settings.
+// files below excluded directories and, if not recursive, inside sub-directories are rejected.
+// without configured extensions, all files with a detectable media-type are accepted
+func (root *MediaRoot) accepts(path string) bool {
+	if path == root.Path || !root.Contains(path) {
+		return false
+	}
+
+	if !root.Recursive && filepath.Dir(path) != root.Path {
+		return false
+	}
+
+	// the file and all its parent-directories below the root
+	for p := filepath.Clean(path); p != root.Path; p = filepath.Dir(p) {
+		if root.excludes(p) {
+			return false
+		}
+	}
+
+	if len(root.Extensions) > 0 {
+		ext := strings.ToLower(filepath.Ext(path))
+
+		for _, e := range root.Extensions {
+			if strings.ToLower(e) == ext {
+				return true
+			}
+		}
+		return false
+	}
+	return detectMediaType(path) != ""
+}
+
+// excludes returns true if the provided path matches one of the root's exclude-patterns,
+// either by its base-name or by its path relative to the root
+func (root *MediaRoot) excludes(path string) bool {
+	rel, _ := filepath.Rel(root.Path, path)
+
+	for _, pattern := range root.Exclude {
+		if match, _ := filepath.Match(pattern, filepath.Base(path)); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, rel); match {
+			return true
+		}
+	}
+	return false
+}
+
+// findMovieFiles walks the provided directory inside this root
+// and returns a sorted list of all movie-paths matching the root's scan-settings.
+// if a single movie-file is provided, it is returned as only item
+func (root *MediaRoot) findMovieFiles(dir string) (files []string) {
+
+	// walk the directory tree
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if f.IsDir() {
+			// skip excluded and, if not recursive, all sub-directories
+			if path != root.Path && (!root.Recursive || root.excludes(path)) {
+				return filepath.SkipDir
+			}
+		} else if root.accepts(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// rootForPath returns the innermost media-root containing the provided path or nil, if not found
+func rootForPath(path string) *MediaRoot {
+	rootsMutex.RLock()
+	defer rootsMutex.RUnlock()
+	return innermostRoot(mediaRoots, path)
+}
+
+// innermostRoot returns the innermost of the provided roots containing the provided path or nil, if not found
+func innermostRoot(roots []*MediaRoot, path string) *MediaRoot {
+	var ret *MediaRoot
+
+	for _, root := range roots {
+		if root.Contains(path) && (ret == nil || len(root.Path) > len(ret.Path)) {
+			ret = root
+		}
+	}
+	return ret
+}
+
+// numLibraryPlaylists returns the number of synthesized "All ..." playlists,
+// which precede all user playlists
+func numLibraryPlaylists() int {
+	rootsMutex.RLock()
+	defer rootsMutex.RUnlock()
+
+	if len(playlists) < len(mediaRoots) {
+		return len(playlists)
+	}
+	return len(mediaRoots)
+}
+
+// rebuildLibraryPlaylists re-creates the synthesized playlists of all media-roots from the movieMap.
+// missing movies outside of all roots are kept in the first playlist.
+// requires a locked movieMutex and playlistMutex
+func rebuildLibraryPlaylists() {
+	roots := getMediaRoots()
+	lists := make([]*Playlist, len(roots))
+
+	for i, root := range roots {
+		lists[i] = &Playlist{Title: root.Title(), Type: PlaylistTypeLibrary, Movies: []*PlaylistEntry{}}
+
+		// keep play-modes and transitions of the previous lists
+		if i < numLibraryPlaylists() {
+			lists[i].Mode = playlists[i].Mode
+			lists[i].Transition = playlists[i].Transition
+		}
+	}
+
+	for _, mov := range movieMap {
+		index := 0
+		movieRoot := innermostRoot(roots, mov.Path)
+		mov.Root = ""
+
+		for i, root := range roots {
+			if root == movieRoot {
+				index = i
+				mov.Root = root.Name
+				break
+			}
+		}
+
+		if len(lists) > 0 {
+			lists[index].Movies = append(lists[index].Movies, newEntry(mov))
+		}
+	}
+
+	for _, list := range lists {
+		movies := list.Movies
+		sort.Slice(movies, func(i, j int) bool { return movies[i].Path < movies[j].Path })
+	}
+	playlists = append(lists, playlists[numLibraryPlaylists():]...)
+	refreshSmartPlaylists()
+}
@@ -0,0 +1,72 @@
+package playlist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMediaRootAccepts(t *testing.T) {
+	media := filepath.FromSlash("/media")
+	exclude := []string{"tmp", "*.part.mp4", filepath.FromSlash("private/*")}
+	recursive := &MediaRoot{Path: media, Extensions: []string{".mp4"}, Recursive: true, Exclude: exclude}
+	flat := &MediaRoot{Path: media, Extensions: []string{".mp4"}, Exclude: exclude}
+
+	tests := []struct {
+		root *MediaRoot
+		path string
+		want bool
+	}{
+		{recursive, "/media/a.mp4", true},
+		{recursive, "/media/a.MP4", true},
+		{recursive, "/media/a.txt", false},
+		{recursive, "/media/sub/a.mp4", true},
+		{recursive, "/media/tmp/a.mp4", false},
+		{recursive, "/media/sub/tmp/deep/a.mp4", false},
+		{recursive, "/media/a.part.mp4", false},
+		{recursive, "/media/private/x/a.mp4", false},
+		{recursive, "/media/privately/a.mp4", true},
+		{recursive, "/other/a.mp4", false},
+		{recursive, "/media", false},
+		{flat, "/media/a.mp4", true},
+		{flat, "/media/sub/a.mp4", false},
+		{flat, "/media/tmp.mp4", true},
+	}
+
+	for _, test := range tests {
+		path := filepath.FromSlash(test.path)
+
+		if got := test.root.accepts(path); got != test.want {
+			t.Errorf("accepts(%s), recursive: %v: got %v, want %v", test.path, test.root.Recursive, got, test.want)
+		}
+	}
+}
+
+// TestFindMovieFilesSingle checks single files, like those of watcher-events, against the root's settings
+func TestFindMovieFilesSingle(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]bool{
+		"a.mp4":         true,
+		"tmp/a.mp4":     false,
+		"sub/a.mp4":     false,
+		"sub/tmp/a.mp4": false,
+	}
+	root := &MediaRoot{Path: dir, Extensions: []string{".mp4"}, Exclude: []string{"tmp"}}
+
+	for name, want := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte("not a movie"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if found := root.findMovieFiles(path); (len(found) == 1) != want {
+			t.Errorf("findMovieFiles(%s): got %v, want found: %v", name, found, want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package playlist
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MovieQuery groups search-terms, filters and pagination for movie-queries,
+// also used as rules of smart playlists. zero-values disable a filter
+type MovieQuery struct {
+	// Text is matched word by word against title, path and tags
+	Text string `json:"text,omitempty"`
+
+	// Tags lists tags, that all need to be present
+	Tags []string `json:"tags,omitempty"`
+
+	// Path selects movies inside the provided directory
+	Path string `json:"path,omitempty"`
+	Root string `json:"root,omitempty"`
+	Type string `json:"type,omitempty"`
+
+	MinDuration float64 `json:"min_duration,omitempty"`
+	MaxDuration float64 `json:"max_duration,omitempty"`
+	MinWidth    int     `json:"min_width,omitempty"`
+	MinHeight   int     `json:"min_height,omitempty"`
+
+	AddedAfter  time.Time `json:"added_after"`
+	AddedBefore time.Time `json:"added_before"`
+
+	// Missing filters by availability, if not nil
+	Missing *bool `json:"missing,omitempty"`
+
+	// Sort is one of "path", "title", "duration", "added", prefixed with '-' for descending order
+	Sort string `json:"sort,omitempty"`
+
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// MovieQueryResult holds a page of movies matching a query
+type MovieQueryResult struct {
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+	Movies []*Movie `json:"movies"`
+}
+
+// MovieMetadata holds changes to user-editable metadata of a movie, nil-values are left unchanged
+type MovieMetadata struct {
+	Path  string   `json:"path"`
+	Title *string  `json:"title"`
+	Tags  []string `json:"tags"`
+	Notes *string  `json:"notes"`
+}
+
+// TagCount holds the number of movies using a tag
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// QueryMovies searches the library, returning a sorted page of matching movies
+func QueryMovies(query MovieQuery) MovieQueryResult {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	movies, total := queryMovies(query)
+	return MovieQueryResult{Total: total, Offset: query.Offset, Limit: query.Limit, Movies: movies}
+}
+
+// queryMovies returns a sorted page of matching movies and the total number of matches.
+// requires a locked movieMutex
+func queryMovies(query MovieQuery) ([]*Movie, int) {
+	words := strings.Fields(strings.ToLower(query.Text))
+	var root *MediaRoot
+
+	if query.Root != "" {
+		if root = GetMediaRoot(query.Root); root == nil {
+			return []*Movie{}, 0
+		}
+	}
+	var matches []*Movie
+
+	for _, mov := range movieMap {
+		if (root == nil || root.Contains(mov.Path)) && mov.matches(&query, words) {
+			matches = append(matches, mov)
+		}
+	}
+	sortMovies(matches, query.Sort)
+
+	start, end := query.Offset, len(matches)
+
+	if start > end {
+		start = end
+	}
+
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+	return append([]*Movie{}, matches[start:end]...), len(matches)
+}
+
+// matches returns true if a movie passes all filters of a query.
+// words are the lower-case words of the query's text
+func (mov *Movie) matches(query *MovieQuery, words []string) bool {
+	if query.Missing != nil && mov.Missing != *query.Missing {
+		return false
+	}
+
+	if query.Type != "" && mov.Type != query.Type {
+		return false
+	}
+
+	if query.Path != "" && !(&MediaRoot{Path: query.Path}).Contains(mov.Path) {
+		return false
+	}
+
+	if (query.MinDuration > 0 && mov.Duration < query.MinDuration) ||
+		(query.MaxDuration > 0 && mov.Duration > query.MaxDuration) {
+		return false
+	}
+
+	if query.MinWidth > 0 || query.MinHeight > 0 {
+		if mov.Info == nil || mov.Info.Width < query.MinWidth || mov.Info.Height < query.MinHeight {
+			return false
+		}
+	}
+
+	if (!query.AddedAfter.IsZero() && mov.Added.Before(query.AddedAfter)) ||
+		(!query.AddedBefore.IsZero() && mov.Added.After(query.AddedBefore)) {
+		return false
+	}
+
+	for _, tag := range query.Tags {
+		if !mov.hasTag(tag) {
+			return false
+		}
+	}
+
+	if len(words) > 0 {
+		text := strings.ToLower(mov.Title + "\n" + mov.Path + "\n" + strings.Join(mov.Tags, "\n"))
+
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasTag returns true if the movie has the provided tag, ignoring case
+func (mov *Movie) hasTag(tag string) bool {
+	for _, t := range mov.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortMovies sorts movies by the provided key, falling back to their path
+func sortMovies(movies []*Movie, key string) {
+	desc := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+
+	less := func(a, b *Movie) bool {
+		switch key {
+		case "title":
+			if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+				return ta < tb
+			}
+		case "duration":
+			if a.Duration != b.Duration {
+				return a.Duration < b.Duration
+			}
+		case "added":
+			if !a.Added.Equal(b.Added) {
+				return a.Added.Before(b.Added)
+			}
+		}
+		return a.Path < b.Path
+	}
+	sort.Slice(movies, func(i, j int) bool {
+		if desc {
+			return less(movies[j], movies[i])
+		}
+		return less(movies[i], movies[j])
+	})
+}
+
+// UpdateMovieMetadata sets title, tags and notes of the movie with the provided path.
+// tags are trimmed and de-duplicated, ignoring case
+func UpdateMovieMetadata(meta MovieMetadata) (*Movie, error) {
+	movieMutex.Lock()
+	mov, ok := movieMap[meta.Path]
+
+	if !ok {
+		movieMutex.Unlock()
+		return nil, os.ErrNotExist
+	}
+
+	if meta.Title != nil {
+		mov.Title = strings.TrimSpace(*meta.Title)
+	}
+
+	if meta.Notes != nil {
+		mov.Notes = *meta.Notes
+	}
+
+	if meta.Tags != nil {
+		mov.Tags = []string{}
+
+		for _, tag := range meta.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" && !mov.hasTag(tag) {
+				mov.Tags = append(mov.Tags, tag)
+			}
+		}
+		sort.Strings(mov.Tags)
+	}
+	movieMutex.Unlock()
+
+	// rules of smart playlists might refer to the changed metadata
+	RefreshSmartPlaylists()
+	return mov, nil
+}
+
+// GetTags returns all tags in use, with the number of movies using them
+func GetTags() []TagCount {
+	counts := make(map[string]int)
+
+	movieMutex.RLock()
+	for _, mov := range movieMap {
+		for _, tag := range mov.Tags {
+			counts[strings.ToLower(tag)]++
+		}
+	}
+	movieMutex.RUnlock()
+
+	tags := []TagCount{}
+
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags
+}
+
+// GetPlaylistSummaries returns all playlists, omitting the movies of the "All ..." playlists.
+// the library can be queried using QueryMovies instead
+func GetPlaylistSummaries() []*Playlist {
+	playlistMutex.RLock()
+	defer playlistMutex.RUnlock()
+
+	numLibrary := numLibraryPlaylists()
+	summaries := make([]*Playlist, 0, len(playlists))
+
+	for _, list := range playlists[:numLibrary] {
+		summary := *list
+		summary.summary = true
+		summaries = append(summaries, &summary)
+	}
+	return append(summaries, playlists[numLibrary:]...)
+}
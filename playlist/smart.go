@@ -0,0 +1,59 @@
+package playlist
+
+// playlist-types, used as discriminator in playlists.json
+const (
+	PlaylistTypeLibrary = "library"
+	PlaylistTypeManual  = "manual"
+	PlaylistTypeSmart   = "smart"
+)
+
+// evaluate re-creates the movies of a smart playlist from its rules.
+// missing movies are excluded, unless the rules select them explicitly.
+// requires a locked movieMutex
+func (list *Playlist) evaluate() {
+	query := *list.Rules
+
+	if query.Missing == nil {
+		available := false
+		query.Missing = &available
+	}
+	movies, _ := queryMovies(query)
+	list.Movies = newEntries(movies)
+}
+
+// refreshSmartPlaylists re-evaluates all smart playlists.
+// requires a locked movieMutex and playlistMutex
+func refreshSmartPlaylists() {
+	for _, list := range playlists {
+		if list.Type == PlaylistTypeSmart && list.Rules != nil {
+			list.evaluate()
+		}
+	}
+}
+
+// RefreshSmartPlaylists re-evaluates all smart playlists, e.g. after metadata of movies changed.
+// playing smart playlists are re-sent by the PlaybackStateUpdater
+func RefreshSmartPlaylists() {
+	movieMutex.Lock()
+	playlistMutex.Lock()
+	refreshSmartPlaylists()
+	playlistMutex.Unlock()
+	movieMutex.Unlock()
+}
+
+// persistentPlaylists returns the provided playlists for saving,
+// smart playlists are saved with their rules only
+func persistentPlaylists(lists []*Playlist) []*Playlist {
+	ret := make([]*Playlist, len(lists))
+
+	for i, list := range lists {
+		ret[i] = list
+
+		if list.Type == PlaylistTypeSmart {
+			listCopy := *list
+			listCopy.summary = true
+			ret[i] = &listCopy
+		}
+	}
+	return ret
+}
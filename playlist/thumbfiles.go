@@ -0,0 +1,168 @@
+package playlist
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// thumbKey returns a collision-free base-name for all thumbnail-files of a movie.
+// based on the movie's path and its content-fingerprint, so byte-identical copies get their own files
+// and changed contents get new names
+func thumbKey(mov *Movie) string {
+	hash := sha1.Sum([]byte(mov.Path + "\x00" + mov.Fingerprint))
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// MigrateThumbnails renames thumbnails from former names, like '<basename>.jpg' or keys of moved movies,
+// to their collision-free names. thumbnails shared by several movies are dropped, so they get regenerated.
+// return: the number of migrated movies
+func MigrateThumbnails(outDir string) int {
+	movieMutex.Lock()
+	thumbMutex.Lock()
+
+	// former names might be shared by movies with the same basename
+	refs := make(map[string]int)
+
+	for _, icon := range IconMap {
+		refs[icon]++
+	}
+	migrated, dropped := 0, 0
+
+	for p, icon := range IconMap {
+		mov, ok := movieMap[p]
+
+		if !ok {
+			// stale entry, leave its file to the garbage-collection
+			delete(IconMap, p)
+			continue
+		}
+		iconPath := filepath.Join(thumbsDirRel, thumbKey(mov)+".jpg")
+
+		// uploaded thumbnails carry a version, see versionedThumbRelPath
+		if icon == iconPath || (mov.CustomIcon && strings.HasPrefix(filepath.Base(icon), thumbKey(mov)+"-")) {
+			continue
+		}
+
+		if refs[icon] > 1 || moveThumbFile(outDir, icon, iconPath) != nil {
+			delete(IconMap, p)
+			mov.IconPath = ""
+			mov.Thumbs = nil
+			mov.Sprite = nil
+			dropped++
+			continue
+		}
+		IconMap[p] = iconPath
+		mov.IconPath = iconPath
+
+		// additional sizes
+		for name, rel := range mov.Thumbs {
+			newRel := thumbRelPath(mov, name+".jpg")
+
+			if name == thumbSettings.IconSize {
+				newRel = iconPath
+			} else if rel != newRel && moveThumbFile(outDir, rel, newRel) != nil {
+				delete(mov.Thumbs, name)
+				continue
+			}
+			mov.Thumbs[name] = newRel
+		}
+
+		// sprite-indices reference their image, so they can not simply be renamed
+		if mov.Sprite != nil && mov.Sprite.Image != thumbRelPath(mov, "sprite.jpg") {
+			mov.Sprite = nil
+		}
+		migrated++
+	}
+	thumbMutex.Unlock()
+	movieMutex.Unlock()
+
+	if migrated > 0 || dropped > 0 {
+		logger.Info("thumbnails migrated", "renamed", migrated, "dropped", dropped)
+		saveIconMap()
+	}
+	return migrated
+}
+
+// moveThumbFile renames a thumbnail-file, both paths are relative to outDir
+func moveThumbFile(outDir, oldRel, newRel string) error {
+	return os.Rename(filepath.Join(outDir, oldRel), filepath.Join(outDir, newRel))
+}
+
+// CollectThumbnailGarbage removes all files from the thumbnail-directory,
+// which are neither referenced by a movie nor part of a running thumbnail-job.
+// return: the served paths of all removed files
+func CollectThumbnailGarbage(outDir string) ([]string, error) {
+	thumbsDirAbs := filepath.Join(outDir, thumbsDirRel)
+	entries, err := os.ReadDir(thumbsDirAbs)
+
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+
+	movieMutex.RLock()
+	thumbMutex.RLock()
+	for _, icon := range IconMap {
+		used[filepath.Base(icon)] = true
+	}
+
+	for _, mov := range movieMap {
+		used[filepath.Base(mov.IconPath)] = true
+
+		for _, rel := range mov.Thumbs {
+			used[filepath.Base(rel)] = true
+		}
+
+		if mov.Sprite != nil {
+			used[filepath.Base(mov.Sprite.Image)] = true
+			used[filepath.Base(mov.Sprite.VTT)] = true
+			used[filepath.Base(mov.Sprite.Index)] = true
+		}
+	}
+	thumbMutex.RUnlock()
+	movieMutex.RUnlock()
+
+	// files of running jobs are not referenced yet
+	var busyKeys []string
+
+	if thumbnails != nil {
+		for _, p := range thumbnails.ActivePaths() {
+			if mov := GetMovie(p); mov != nil {
+				busyKeys = append(busyKeys, thumbKey(mov))
+			}
+		}
+	}
+	removed := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || strings.HasPrefix(name, ".") || used[name] || hasAnyPrefix(name, busyKeys) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(thumbsDirAbs, name)); err != nil {
+			logger.Warn("could not remove thumbnail", "error", err)
+			continue
+		}
+		removed = append(removed, filepath.Join(thumbsDirRel, name))
+	}
+
+	if len(removed) > 0 {
+		logger.Info("removed unused thumbnails", "files", len(removed))
+	}
+	return removed, nil
+}
+
+// hasAnyPrefix returns true if str starts with one of the provided prefixes
+func hasAnyPrefix(str string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(str, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,539 @@
+package playlist
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/notify"
+)
+
+// states of a ThumbnailJob
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// priorities for thumbnail-jobs, higher priorities are processed first
+const (
+	PriorityLow     = 0
+	PriorityNew     = 1
+	PriorityVisible = 10
+)
+
+// thumbnailDuration records the runtime of finished thumbnail-jobs, by their final state
+var thumbnailDuration = metrics.NewHistogram("zug_thumbnail_job_duration_seconds",
+	"Runtime of thumbnail-jobs.", "state", metrics.DurationBuckets)
+
+// ThumbnailJob describes the thumbnail-generation for a single movie
+type ThumbnailJob struct {
+	ID       int       `json:"id"`
+	Path     string    `json:"path"`
+	Priority int       `json:"priority"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	movie *Movie
+	icon  string
+	ctx   context.Context
+
+	// indexing fingerprints new or changed movies and detects their media-type first,
+	// added movies are checked for renames. indexed movies only get a thumbnail, if they have none
+	indexing, added bool
+
+	// regenerate replaces custom thumbnails, which are kept otherwise
+	regenerate bool
+
+	// a request for the movie, which arrived while the job was running.
+	// the movie might have changed during the generation, so it is queued again once the job finished
+	pending *ThumbnailJob
+
+	cancel context.CancelFunc
+
+	// position inside the jobQueue
+	index int
+}
+
+// ThumbnailStatus summarizes the state of a ThumbnailPipeline.
+// counters refer to the current batch of jobs and reset once the pipeline is idle
+type ThumbnailStatus struct {
+	Workers   int            `json:"workers"`
+	Queued    int            `json:"queued"`
+	Running   int            `json:"running"`
+	Done      int            `json:"done"`
+	Failed    int            `json:"failed"`
+	Cancelled int            `json:"cancelled"`
+	Jobs      []ThumbnailJob `json:"jobs"`
+}
+
+// jobQueue implements heap.Interface, ordered by priority and insertion
+type jobQueue []*ThumbnailJob
+
+func (queue jobQueue) Len() int { return len(queue) }
+
+func (queue jobQueue) Less(i, j int) bool {
+	if queue[i].Priority != queue[j].Priority {
+		return queue[i].Priority > queue[j].Priority
+	}
+	return queue[i].ID < queue[j].ID
+}
+
+func (queue jobQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *jobQueue) Push(x interface{}) {
+	job := x.(*ThumbnailJob)
+	job.index = len(*queue)
+	*queue = append(*queue, job)
+}
+
+func (queue *jobQueue) Pop() interface{} {
+	old := *queue
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*queue = old[:len(old)-1]
+	return job
+}
+
+// ThumbnailPipeline generates thumbnails in the background,
+// using a bounded number of workers and processing high-priority jobs first
+type ThumbnailPipeline struct {
+	outDir     string
+	numWorkers int
+	mutex      sync.Mutex
+	wake       *sync.Cond
+	queue      jobQueue
+
+	// queued and running jobs by movie-path
+	active map[string]*ThumbnailJob
+
+	// running jobs, including restarted ones that were replaced in active
+	running map[*ThumbnailJob]bool
+
+	nextID                  int
+	done, failed, cancelled int
+
+	// IconMap needs to be saved, once the pipeline is idle
+	dirty bool
+}
+
+// thumbnails is the pipeline used by the playlist module
+var thumbnails *ThumbnailPipeline
+
+// StartThumbnailPipeline creates the module's thumbnail-pipeline,
+// writing thumbnails to outDir, using numWorkers concurrent workers
+func StartThumbnailPipeline(outDir string, numWorkers int) *ThumbnailPipeline {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	pipeline := &ThumbnailPipeline{
+		outDir:     outDir,
+		numWorkers: numWorkers,
+		active:     make(map[string]*ThumbnailJob),
+		running:    make(map[*ThumbnailJob]bool),
+	}
+	pipeline.wake = sync.NewCond(&pipeline.mutex)
+
+	for i := 0; i < numWorkers; i++ {
+		go pipeline.worker()
+	}
+	thumbnails = pipeline
+	return pipeline
+}
+
+// Enqueue adds a thumbnail-job for the provided movie.
+// if a job for the movie is already queued, its priority is raised if necessary
+func (pipeline *ThumbnailPipeline) Enqueue(mov *Movie, priority int) {
+	pipeline.enqueue(mov, priority, false, false, false)
+}
+
+// enqueue adds a job for the provided movie, optionally indexing it first or replacing a custom thumbnail
+func (pipeline *ThumbnailPipeline) enqueue(mov *Movie, priority int, indexing, added, regenerate bool) {
+	movieMutex.RLock()
+	path, icon := mov.Path, mov.IconPath
+	movieMutex.RUnlock()
+
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	if job, ok := pipeline.active[path]; ok {
+		merged := job
+
+		if job.State == JobRunning {
+			if job.pending == nil {
+				job.pending = &ThumbnailJob{Path: path, Priority: priority}
+			}
+			merged = job.pending
+		}
+		merged.indexing = merged.indexing || indexing
+		merged.added = merged.added || added
+		merged.regenerate = merged.regenerate || regenerate
+
+		if priority > merged.Priority {
+			merged.Priority = priority
+
+			if merged == job {
+				heap.Fix(&pipeline.queue, job.index)
+			}
+		}
+		return
+	}
+	pipeline.nextID++
+	job := &ThumbnailJob{
+		ID:       pipeline.nextID,
+		Path:     path,
+		Priority: priority,
+		State:    JobQueued,
+		Queued:   time.Now(),
+		movie:    mov,
+		icon:     icon,
+		indexing: indexing,
+		added:    added,
+
+		regenerate: regenerate,
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	pipeline.active[path] = job
+	heap.Push(&pipeline.queue, job)
+	pipeline.wake.Signal()
+}
+
+// Restart replaces a queued or running job for the provided movie with a new one,
+// e.g. after its thumbnail-settings changed. a custom thumbnail is replaced as well
+func (pipeline *ThumbnailPipeline) Restart(mov *Movie, priority int) {
+	movieMutex.RLock()
+	path := mov.Path
+	movieMutex.RUnlock()
+
+	pipeline.mutex.Lock()
+	var progress *ThumbnailProgress
+
+	if job, ok := pipeline.active[path]; ok {
+		job.cancel()
+
+		// running jobs are finished by their worker
+		if job.State == JobQueued {
+			heap.Remove(&pipeline.queue, job.index)
+			progress = pipeline.finish(job, nil)
+		}
+		delete(pipeline.active, path)
+	}
+	pipeline.mutex.Unlock()
+
+	if progress != nil {
+		sendThumbnailProgress(progress)
+	}
+	pipeline.enqueue(mov, priority, false, false, true)
+}
+
+// Prioritize raises the priority of queued jobs for the provided movie-paths
+func (pipeline *ThumbnailPipeline) Prioritize(paths []string, priority int) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	for _, p := range paths {
+		if job, ok := pipeline.active[p]; ok && job.State == JobQueued && priority > job.Priority {
+			job.Priority = priority
+			heap.Fix(&pipeline.queue, job.index)
+		}
+	}
+}
+
+// Cancel cancels queued and running jobs for the provided movie-paths.
+// if no paths are provided, all jobs are cancelled.
+// return: the number of cancelled jobs
+func (pipeline *ThumbnailPipeline) Cancel(paths []string) int {
+	pipeline.mutex.Lock()
+
+	selected := make(map[string]bool)
+
+	for _, p := range paths {
+		selected[p] = true
+	}
+	var jobs []*ThumbnailJob
+
+	// running jobs include restarted ones, which are no longer active
+	for _, job := range append(append([]*ThumbnailJob{}, pipeline.queue...), pipeline.runningJobs()...) {
+		if len(paths) == 0 || selected[job.Path] {
+			jobs = append(jobs, job)
+		}
+	}
+	var progress []*ThumbnailProgress
+
+	for _, job := range jobs {
+		job.cancel()
+		job.pending = nil
+
+		// running jobs are finished by their worker
+		if job.State == JobQueued {
+			heap.Remove(&pipeline.queue, job.index)
+			progress = append(progress, pipeline.finish(job, nil))
+		}
+	}
+	pipeline.mutex.Unlock()
+
+	for _, p := range progress {
+		sendThumbnailProgress(p)
+	}
+	return len(jobs)
+}
+
+// ActivePaths returns the movie-paths of all queued and running jobs
+func (pipeline *ThumbnailPipeline) ActivePaths() []string {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	paths := make([]string, 0, len(pipeline.active))
+
+	for p := range pipeline.active {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// Status returns a summary of the pipeline, including all queued and running jobs
+func (pipeline *ThumbnailPipeline) Status() ThumbnailStatus {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	status := ThumbnailStatus{
+		Workers:   pipeline.numWorkers,
+		Queued:    pipeline.queue.Len(),
+		Running:   len(pipeline.running),
+		Done:      pipeline.done,
+		Failed:    pipeline.failed,
+		Cancelled: pipeline.cancelled,
+		Jobs:      []ThumbnailJob{},
+	}
+
+	for _, job := range append(append([]*ThumbnailJob{}, pipeline.queue...), pipeline.runningJobs()...) {
+		status.Jobs = append(status.Jobs, *job)
+	}
+
+	// running jobs first, followed by the queue in processing-order
+	sort.Slice(status.Jobs, func(i, j int) bool {
+		a, b := status.Jobs[i], status.Jobs[j]
+
+		if a.State != b.State {
+			return a.State == JobRunning
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.ID < b.ID
+	})
+	return status
+}
+
+func (pipeline *ThumbnailPipeline) worker() {
+	for {
+		pipeline.mutex.Lock()
+
+		for pipeline.queue.Len() == 0 {
+			pipeline.wake.Wait()
+		}
+		job := heap.Pop(&pipeline.queue).(*ThumbnailJob)
+		job.State = JobRunning
+		job.Started = time.Now()
+		pipeline.running[job] = true
+		pipeline.mutex.Unlock()
+
+		sendThumbnailProgress(pipeline.progress(job))
+		mov, generate := job.movie, true
+
+		// new movies need their metadata as well
+		if job.indexing {
+			mov = indexMovie(mov, job.added)
+			generate = !hasIcon(job.Path)
+		} else if _, err := mov.probe(false); err != nil {
+			logger.Warn("could not probe movie", "path", job.Path, "error", err)
+		}
+		var err error
+
+		// uploaded thumbnails are kept, until they are regenerated explicitly
+		if generate && !job.regenerate {
+			movieMutex.RLock()
+			generate = !mov.CustomIcon
+			movieMutex.RUnlock()
+		}
+
+		if generate {
+			err = generateThumbnail(job.ctx, mov, pipeline.outDir)
+		}
+
+		movieMutex.RLock()
+		icon := mov.IconPath
+		movieMutex.RUnlock()
+
+		pipeline.mutex.Lock()
+		job.movie = mov
+		job.icon = icon
+		progress := pipeline.finish(job, err)
+		pending := job.pending
+		job.pending = nil
+		saveIcons := pipeline.dirty && pipeline.idle() && pending == nil
+
+		// alerts are sent without holding the mutex
+		var failed *ThumbnailJob
+
+		if job.State == JobFailed {
+			copied := *job
+			failed = &copied
+		}
+
+		if saveIcons {
+			pipeline.dirty = false
+		}
+		pipeline.mutex.Unlock()
+
+		sendThumbnailProgress(progress)
+
+		if pending != nil {
+			pipeline.enqueue(mov, pending.Priority, pending.indexing, pending.added, pending.regenerate)
+		}
+
+		if failed != nil {
+			alertThumbnailFailed(failed)
+		}
+
+		if saveIcons {
+			saveIconMap()
+
+			// probed durations and dimensions might change smart playlists
+			RefreshSmartPlaylists()
+		}
+	}
+}
+
+// finish sets the final state of a job and updates the batch-counters.
+// requires a locked mutex
+func (pipeline *ThumbnailPipeline) finish(job *ThumbnailJob, err error) *ThumbnailProgress {
+	job.Finished = time.Now()
+
+	switch {
+	case job.ctx.Err() != nil:
+		job.State = JobCancelled
+		pipeline.cancelled++
+	case err != nil:
+		job.State = JobFailed
+		job.Error = err.Error()
+		pipeline.failed++
+	default:
+		job.State = JobDone
+		pipeline.done++
+		pipeline.dirty = true
+	}
+	job.cancel()
+
+	if !job.Started.IsZero() {
+		thumbnailDuration.Observe(job.State, job.Finished.Sub(job.Started).Seconds())
+	}
+
+	// restarted jobs were replaced by a new job already
+	if pipeline.active[job.Path] == job {
+		delete(pipeline.active, job.Path)
+	}
+	delete(pipeline.running, job)
+	progress := pipeline.progressLocked(job)
+
+	// start a new batch
+	if pipeline.idle() {
+		logger.Info("thumbnails done", "generated", pipeline.done, "failed", pipeline.failed,
+			"cancelled", pipeline.cancelled)
+		pipeline.done, pipeline.failed, pipeline.cancelled = 0, 0, 0
+	}
+	return progress
+}
+
+// alertThumbnailFailed sends an alert for a failed job.
+// the title holds the movie-path, so failures of different movies are rate-limited separately
+func alertThumbnailFailed(job *ThumbnailJob) {
+	notify.Send(&notify.Alert{
+		Event:    notify.EventThumbnailFailed,
+		Severity: notify.SeverityWarning,
+		Title:    "thumbnail failed: " + job.Path,
+		Message:  job.Error,
+		Data:     job,
+	})
+}
+
+// runningJobs returns all running jobs. requires a locked mutex
+func (pipeline *ThumbnailPipeline) runningJobs() []*ThumbnailJob {
+	jobs := make([]*ThumbnailJob, 0, len(pipeline.running))
+
+	for job := range pipeline.running {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// idle returns true, if no jobs are queued or running. requires a locked mutex
+func (pipeline *ThumbnailPipeline) idle() bool {
+	return pipeline.queue.Len() == 0 && len(pipeline.running) == 0
+}
+
+// progress creates a ThumbnailProgress for the provided job
+func (pipeline *ThumbnailPipeline) progress(job *ThumbnailJob) *ThumbnailProgress {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+	return pipeline.progressLocked(job)
+}
+
+// progressLocked creates a ThumbnailProgress for the provided job. requires a locked mutex
+func (pipeline *ThumbnailPipeline) progressLocked(job *ThumbnailJob) *ThumbnailProgress {
+	finished := pipeline.done + pipeline.failed + pipeline.cancelled
+
+	return &ThumbnailProgress{
+		Path:     job.Path,
+		IconPath: job.icon,
+		State:    job.State,
+		Error:    job.Error,
+		Index:    finished,
+		Total:    finished + pipeline.queue.Len() + len(pipeline.running),
+	}
+}
+
+// enqueueThumbnails adds jobs for all provided movies to the module's pipeline
+func enqueueThumbnails(movies []*Movie, priority int) {
+	if thumbnails == nil {
+		logger.Warn("no thumbnail-pipeline running")
+		return
+	}
+
+	for _, mov := range movies {
+		thumbnails.Enqueue(mov, priority)
+	}
+}
+
+// enqueueIndexing adds jobs for new or changed movies to the module's pipeline
+func enqueueIndexing(movies []*Movie, added bool, priority int) {
+	if thumbnails == nil {
+		logger.Warn("no thumbnail-pipeline running")
+		return
+	}
+
+	for _, mov := range movies {
+		thumbnails.enqueue(mov, priority, true, added, false)
+	}
+}
+
+// hasIcon returns true, if the IconMap holds a thumbnail for the provided movie-path
+func hasIcon(path string) bool {
+	thumbMutex.RLock()
+	defer thumbMutex.RUnlock()
+	_, ok := IconMap[path]
+	return ok
+}
@@ -0,0 +1,98 @@
+package playlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestThumbnailPipelineRace runs the pipeline while the library is encoded, like Save and the http-handlers do.
+// run with -race
+func TestThumbnailPipelineRace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "thumbnails")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no external tools, keep all files inside the temporary directory
+	FFProbePath = filepath.Join(dir, "ffprobe")
+	FFMpegPath = filepath.Join(dir, "ffmpeg")
+	thumbsFile = filepath.Join(dir, "thumbs.json")
+
+	var movies []*Movie
+
+	movieMutex.Lock()
+	movieMap = make(map[string]*Movie)
+
+	for i := 0; i < 16; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("movie%02d.mp4", i))
+
+		if err := os.WriteFile(p, []byte("not a movie"), 0644); err != nil {
+			movieMutex.Unlock()
+			t.Fatal(err)
+		}
+		mov := &Movie{Path: p, Type: MediaTypeVideo}
+		movieMap[p] = mov
+		movies = append(movies, mov)
+	}
+	movieMutex.Unlock()
+
+	thumbMutex.Lock()
+	IconMap = make(map[string]string)
+	thumbMutex.Unlock()
+
+	done := make(chan bool)
+	started := make(chan bool)
+	encoded := make(chan bool)
+
+	go func() {
+		defer close(encoded)
+
+		for i := 0; ; i++ {
+			if i == 1 {
+				close(started)
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			movieMutex.RLock()
+			json.NewEncoder(io.Discard).Encode(movieMap)
+			movieMutex.RUnlock()
+		}
+	}()
+
+	<-started
+	pipeline := StartThumbnailPipeline(filepath.Join(dir, "out"), 4)
+	enqueueThumbnails(movies, PriorityNew)
+
+	// restarted jobs must not disturb the counters
+	pipeline.Restart(movies[0], PriorityVisible)
+	deadline := time.Now().Add(30 * time.Second)
+
+	for {
+		status := pipeline.Status()
+
+		if status.Running < 0 || status.Running > status.Workers {
+			t.Fatalf("invalid number of running jobs: %d", status.Running)
+		}
+
+		if status.Queued == 0 && status.Running == 0 && len(status.Jobs) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline not idle: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-encoded
+}
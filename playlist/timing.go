@@ -0,0 +1,157 @@
+package playlist
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// UpcomingItem describes a playlist item that will be played after the current one.
+// items of the play-next queue have a MovieIndex of -1
+type UpcomingItem struct {
+	MovieIndex int       `json:"movie_index"`
+	Path       string    `json:"path"`
+	Start      time.Time `json:"start"`
+}
+
+// TotalDuration returns the runtime of all playable entries, including their loops and delays
+func (list *Playlist) TotalDuration() float64 {
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+	return list.totalDuration()
+}
+
+// totalDuration returns the runtime of all available entries. requires a locked movieMutex
+func (list *Playlist) totalDuration() float64 {
+	var total float64
+
+	for _, entry := range list.Movies {
+		if !entry.Missing {
+			total += entry.runtime()
+		}
+	}
+	return total
+}
+
+// MarshalJSON encodes the playlist, including its total runtime and number of movies.
+// requires a locked movieMutex and playlistMutex, see EncodeJSON
+func (list *Playlist) MarshalJSON() ([]byte, error) {
+	type playlistAlias Playlist
+	alias := playlistAlias(*list)
+
+	if list.summary {
+		alias.Movies = []*PlaylistEntry{}
+	}
+
+	return json.Marshal(&struct {
+		*playlistAlias
+		Duration  float64 `json:"duration"`
+		NumMovies int     `json:"num_movies"`
+	}{&alias, list.totalDuration(), len(list.Movies)})
+}
+
+// applyTrim converts the player's position inside the current movie
+// to a position relative to the trimmed range of the current entry, which might be nil
+func (state *PlaybackState) applyTrim(current *PlaylistEntry) {
+	state.MoviePosition = state.Position
+	state.MovieDuration = state.Duration
+
+	if current == nil {
+		return
+	}
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	start, end := current.trim(state.Duration)
+
+	if end <= start {
+		return
+	}
+	state.Position = math.Min(math.Max(state.Position-start, 0), end-start)
+	state.Duration = end - start
+}
+
+// updateTiming derives remaining times and the expected start of upcoming items
+// from the current position inside the play-order of the provided playlist.
+// entries are the items sent to the player, in the order of their playlist-indices.
+// if repeats is true, the order is repeated after the current pass.
+// delays are assumed to follow the movie they belong to
+func (state *PlaybackState) updateTiming(list *Playlist, order []int, entries []*PlaylistEntry,
+	repeats bool, now time.Time) {
+	state.MovieRemaining = 0
+	state.PlaylistRemaining = 0
+	state.PlaylistDuration = 0
+	state.LoopRestart = time.Time{}
+	state.Upcoming = nil
+
+	if list == nil {
+		return
+	}
+	state.PlaylistDuration = list.TotalDuration()
+
+	if !state.Connected || !state.Playing || state.Finished ||
+		state.OrderPosition < 0 || state.OrderPosition >= len(entries) {
+		return
+	}
+
+	toDuration := func(seconds float64) time.Duration {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	movieMutex.RLock()
+	defer movieMutex.RUnlock()
+
+	current := entries[state.OrderPosition]
+	duration := state.Duration
+
+	if duration <= 0 {
+		duration = current.playDuration()
+	}
+
+	if state.MovieRemaining = duration - state.Position; state.MovieRemaining < 0 {
+		state.MovieRemaining = 0
+	}
+
+	// the player's rate scales the current item, upcoming items use their own rates
+	rate := state.Rate
+
+	if rate <= 0 {
+		rate = current.rate()
+	}
+	remaining := state.MovieRemaining/rate + current.Delay
+	next := now.Add(toDuration(remaining))
+
+	addUpcoming := func(i int) {
+		index, entry := order[i], entries[i]
+
+		// cross-fades start before their predecessor ends
+		overlap := list.transition(entry).overlap()
+		next = next.Add(-toDuration(overlap))
+		remaining -= overlap
+
+		state.Upcoming = append(state.Upcoming, UpcomingItem{
+			MovieIndex: index,
+			Path:       entry.Path,
+			Start:      next,
+		})
+		next = next.Add(toDuration(entry.itemRuntime()))
+		remaining += entry.itemRuntime()
+	}
+
+	// remaining items of the current pass
+	for i := state.OrderPosition + 1; i < len(entries); i++ {
+		addUpcoming(i)
+	}
+	state.PlaylistRemaining = remaining
+	state.LoopRestart = next
+
+	// items of the next pass, which are known in advance for repeated orders only.
+	// inserted items are removed after the current pass
+	if repeats {
+		for i := 0; i < state.OrderPosition; i++ {
+			if order[i] >= 0 {
+				addUpcoming(i)
+			}
+		}
+	}
+}
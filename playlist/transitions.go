@@ -0,0 +1,79 @@
+package playlist
+
+import (
+	"fmt"
+)
+
+// transition-types between playlist items
+const (
+	TransitionCut       = "cut"
+	TransitionFadeBlack = "fade_black"
+	TransitionCrossfade = "crossfade"
+)
+
+// Transition describes how a playlist item is blended in
+type Transition struct {
+	Type string `json:"type"`
+
+	// Duration of the transition in seconds, ignored for cuts
+	Duration float64 `json:"duration"`
+}
+
+// defaultTransition is used, if neither entry nor playlist configure a transition
+var defaultTransition = Transition{Type: TransitionCut}
+
+// validate checks type and duration of a transition
+func (transition *Transition) validate() error {
+	switch transition.Type {
+	case TransitionCut, TransitionFadeBlack, TransitionCrossfade:
+	default:
+		return fmt.Errorf("unknown transition: %s", transition.Type)
+	}
+
+	if transition.Duration < 0 {
+		return fmt.Errorf("invalid transition-duration: %.3f", transition.Duration)
+	}
+	return nil
+}
+
+// transition returns the transition into an entry of the playlist,
+// entries override the playlist's transition. list may be nil for items outside a playlist.
+// requires a locked movieMutex
+func (list *Playlist) transition(entry *PlaylistEntry) Transition {
+	switch {
+	case entry.Transition != nil:
+		return *entry.Transition
+	case list != nil && list.Transition != nil:
+		return *list.Transition
+	}
+	return defaultTransition
+}
+
+// overlap returns the time an item shares with its predecessor
+func (transition Transition) overlap() float64 {
+	if transition.Type == TransitionCrossfade {
+		return transition.Duration
+	}
+	return 0
+}
+
+// SetTransition sets the default transition of the playlist with the provided index.
+// the transition takes effect with the next playback of the playlist.
+// transitions of "All ..." playlists are kept in memory only
+func SetTransition(playlistIndex int, transition *Transition) error {
+	if transition != nil {
+		if err := transition.validate(); err != nil {
+			return err
+		}
+	}
+	movieMutex.Lock()
+	defer movieMutex.Unlock()
+	playlistMutex.Lock()
+	defer playlistMutex.Unlock()
+
+	if playlistIndex < 0 || playlistIndex >= len(playlists) {
+		return fmt.Errorf("playlist-index out of range: %d", playlistIndex)
+	}
+	playlists[playlistIndex].Transition = transition
+	return nil
+}
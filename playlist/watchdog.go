@@ -0,0 +1,381 @@
+package playlist
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/jsonfile"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/notify"
+)
+
+var watchdogLogger = logging.New("watchdog")
+
+// conditions checked by watchdog-rules
+const (
+	WatchdogDisconnected = "disconnected"
+	WatchdogFrozen       = "frozen"
+	WatchdogRateZero     = "rate_zero"
+)
+
+// recovery-actions of watchdog-rules
+const (
+	WatchdogResend = "resend"
+	WatchdogScript = "script"
+	WatchdogAlert  = "alert"
+)
+
+// WatchdogRule triggers recovery-actions, once its condition held for a while
+type WatchdogRule struct {
+	Name string `json:"name"`
+
+	// Condition is one of WatchdogDisconnected, WatchdogFrozen (position not advancing while playing)
+	// or WatchdogRateZero (playing with a rate of zero)
+	Condition string `json:"condition"`
+
+	// After is the time in seconds the condition needs to hold, before the rule triggers
+	After float64 `json:"after"`
+
+	// Actions are any of WatchdogResend, WatchdogScript and WatchdogAlert
+	Actions []string `json:"actions"`
+
+	// Script is run by WatchdogScript, with the incident passed in WATCHDOG_* environment-variables
+	Script string `json:"script,omitempty"`
+
+	// Repeat triggers the rule again after the provided seconds, while the condition holds.
+	// zero triggers once, until the condition cleared
+	Repeat float64 `json:"repeat,omitempty"`
+}
+
+// WatchdogSettings configures the player-watchdog
+type WatchdogSettings struct {
+	Enabled bool           `json:"enabled"`
+	Rules   []WatchdogRule `json:"rules"`
+
+	// ScriptTimeout limits the runtime of scripts in seconds
+	ScriptTimeout float64 `json:"script_timeout"`
+}
+
+// Incident is reported whenever a watchdog-rule triggers or its condition cleared
+type Incident struct {
+	Rule      string    `json:"rule"`
+	Condition string    `json:"condition"`
+	Since     time.Time `json:"since"`
+	Time      time.Time `json:"time"`
+	Resolved  bool      `json:"resolved"`
+	Actions   []string  `json:"actions,omitempty"`
+	Errors    []string  `json:"errors,omitempty"`
+
+	// playback at the time of the incident
+	Path     string  `json:"path"`
+	Position float64 `json:"position"`
+}
+
+// watchdogSettings holds the active watchdog-settings
+var watchdogSettings = WatchdogSettings{
+	Enabled: false,
+	Rules: []WatchdogRule{
+		{Name: "player offline", Condition: WatchdogDisconnected, After: 30, Actions: []string{WatchdogAlert}},
+		{Name: "playback frozen", Condition: WatchdogFrozen, After: 15,
+			Actions: []string{WatchdogResend, WatchdogAlert}},
+	},
+	ScriptTimeout: 60,
+}
+
+var watchdogSettingsFile = "watchdogSettings.json"
+
+// WatchdogEvents receives all incidents
+var WatchdogEvents chan<- *Incident
+
+// the most recent incidents, oldest first
+var incidents []*Incident
+var incidentMutex sync.RWMutex
+
+const maxIncidents = 100
+
+// frozenEndMargin is the remaining time in seconds, at which an item counts as ended for WatchdogFrozen
+const frozenEndMargin = 0.5
+
+// watchdogRuleState tracks a single rule between state-updates
+type watchdogRuleState struct {
+	since     time.Time
+	triggered time.Time
+}
+
+// watchdog checks the rules against every state-update,
+// in its own goroutine, so running scripts do not delay the state-updates
+type watchdog struct {
+	rules        []WatchdogRule
+	ruleStates   []watchdogRuleState
+	lastPosition float64
+	updates      chan PlaybackState
+}
+
+// LoadWatchdogSettings reads the watchdog-settings from their json-file, if present.
+// settings missing in the file keep their defaults, invalid rules are dropped
+func LoadWatchdogSettings() WatchdogSettings {
+	if err := jsonfile.Load(watchdogSettingsFile, &watchdogSettings); err != nil {
+		watchdogLogger.Error("could not parse watchdog-settings", "error", err)
+	}
+	rules := []WatchdogRule{}
+
+	for _, rule := range watchdogSettings.Rules {
+		if err := rule.validate(); err != nil {
+			watchdogLogger.Warn("invalid rule", "rule", rule.Name, "error", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	watchdogSettings.Rules = rules
+	return watchdogSettings
+}
+
+// GetWatchdogSettings returns the active watchdog-settings
+func GetWatchdogSettings() WatchdogSettings {
+	return watchdogSettings
+}
+
+// GetIncidents returns the most recent incidents, oldest first
+func GetIncidents() []*Incident {
+	incidentMutex.RLock()
+	defer incidentMutex.RUnlock()
+	return append([]*Incident{}, incidents...)
+}
+
+// validate checks condition and actions of a rule
+func (rule *WatchdogRule) validate() error {
+	switch rule.Condition {
+	case WatchdogDisconnected, WatchdogFrozen, WatchdogRateZero:
+	default:
+		return fmt.Errorf("unknown condition: %s", rule.Condition)
+	}
+
+	for _, action := range rule.Actions {
+		switch action {
+		case WatchdogResend, WatchdogAlert:
+		case WatchdogScript:
+			if rule.Script == "" {
+				return fmt.Errorf("action '%s' without script", action)
+			}
+		default:
+			return fmt.Errorf("unknown action: %s", action)
+		}
+	}
+	return nil
+}
+
+// newWatchdog creates and starts a watchdog for the active settings, nil if disabled
+func newWatchdog(updater *PlaybackStateUpdater) *watchdog {
+	if !watchdogSettings.Enabled || len(watchdogSettings.Rules) == 0 {
+		return nil
+	}
+	dog := &watchdog{
+		rules:      watchdogSettings.Rules,
+		ruleStates: make([]watchdogRuleState, len(watchdogSettings.Rules)),
+		updates:    make(chan PlaybackState, 10),
+	}
+	watchdogLogger.Info("watchdog started", "rules", len(dog.rules))
+
+	go func() {
+		for state := range dog.updates {
+			dog.check(updater, state, time.Now())
+		}
+	}()
+	return dog
+}
+
+// push passes a state-update to the watchdog, updates are dropped while it is busy
+func (dog *watchdog) push(state PlaybackState) {
+	if dog == nil {
+		return
+	}
+
+	select {
+	case dog.updates <- state:
+	default:
+	}
+}
+
+// holds returns true, if a condition holds for the provided state
+func (dog *watchdog) holds(condition string, state *PlaybackState, frozen bool) bool {
+	switch condition {
+	case WatchdogDisconnected:
+		return !state.Connected
+	case WatchdogFrozen:
+		return state.Connected && state.Playing && frozen
+	case WatchdogRateZero:
+		return state.Connected && state.Playing && state.Rate == 0
+	}
+	return false
+}
+
+// check evaluates all rules for a state-update and runs the actions of triggered rules
+func (dog *watchdog) check(updater *PlaybackStateUpdater, state PlaybackState, now time.Time) {
+	// the position stands still at the end of an item as well, while the player holds its last frame
+	// during the item's delay
+	frozen := state.MoviePosition == dog.lastPosition && state.MovieRemaining > frozenEndMargin
+	dog.lastPosition = state.MoviePosition
+
+	for i, rule := range dog.rules {
+		ruleState := &dog.ruleStates[i]
+
+		if !dog.holds(rule.Condition, &state, frozen) {
+			if !ruleState.triggered.IsZero() {
+				incident := &Incident{Rule: rule.Name, Condition: rule.Condition, Since: ruleState.since,
+					Time: now, Resolved: true, Path: state.Path, Position: state.MoviePosition}
+
+				if rule.alerts() {
+					alertIncident(incident)
+				}
+				reportIncident(incident)
+			}
+			*ruleState = watchdogRuleState{}
+			continue
+		}
+
+		if ruleState.since.IsZero() {
+			ruleState.since = now
+		}
+
+		if now.Sub(ruleState.since).Seconds() < rule.After {
+			continue
+		}
+
+		if !ruleState.triggered.IsZero() &&
+			(rule.Repeat <= 0 || now.Sub(ruleState.triggered).Seconds() < rule.Repeat) {
+			continue
+		}
+		ruleState.triggered = now
+
+		incident := &Incident{Rule: rule.Name, Condition: rule.Condition, Since: ruleState.since, Time: now,
+			Actions: rule.Actions, Path: state.Path, Position: state.MoviePosition}
+		dog.runActions(updater, &rule, incident)
+		reportIncident(incident)
+	}
+}
+
+// runActions runs the recovery-actions of a triggered rule, collecting their errors in the incident
+func (dog *watchdog) runActions(updater *PlaybackStateUpdater, rule *WatchdogRule, incident *Incident) {
+	for _, action := range rule.Actions {
+		var err error
+
+		switch action {
+		case WatchdogResend:
+			err = updater.resend()
+		case WatchdogScript:
+			err = runWatchdogScript(rule.Script, incident)
+		case WatchdogAlert:
+			watchdogLogger.Warn("alert", "rule", rule.Name, "since", incident.Since.Format(time.RFC3339))
+			alertIncident(incident)
+		}
+
+		if err != nil {
+			incident.Errors = append(incident.Errors, fmt.Sprintf("%s: %v", action, err))
+		}
+	}
+}
+
+// alerts returns true, if the rule notifies about its incidents
+func (rule *WatchdogRule) alerts() bool {
+	for _, action := range rule.Actions {
+		if action == WatchdogAlert {
+			return true
+		}
+	}
+	return false
+}
+
+// alertIncident sends a notification for an incident, disconnects are reported as EventPlayerOffline
+func alertIncident(incident *Incident) {
+	alert := &notify.Alert{
+		Event:    notify.EventWatchdog,
+		Severity: notify.SeverityError,
+		Title:    incident.Rule,
+		Message:  "since " + incident.Since.Format(time.RFC3339),
+		Time:     incident.Time,
+		Data:     incident,
+	}
+
+	if incident.Condition == WatchdogDisconnected {
+		alert.Event = notify.EventPlayerOffline
+	}
+
+	if incident.Resolved {
+		alert.Severity = notify.SeverityInfo
+		alert.Title += " resolved"
+		alert.Message = "after " + incident.Time.Sub(incident.Since).Round(time.Second).String()
+	}
+	notify.Send(alert)
+}
+
+// runWatchdogScript runs a recovery-script, limited by the configured timeout
+func runWatchdogScript(script string, incident *Incident) error {
+	timeout := time.Duration(watchdogSettings.ScriptTimeout * float64(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(),
+		"WATCHDOG_RULE="+incident.Rule,
+		"WATCHDOG_CONDITION="+incident.Condition,
+		"WATCHDOG_SINCE="+incident.Since.Format(time.RFC3339),
+		"WATCHDOG_PATH="+incident.Path)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// reportIncident logs an incident, keeps it in the list of recent incidents and pushes it to WatchdogEvents
+func reportIncident(incident *Incident) {
+	if incident.Resolved {
+		watchdogLogger.Info("resolved", "rule", incident.Rule,
+			"after", incident.Time.Sub(incident.Since).Round(time.Second))
+	} else {
+		watchdogLogger.Warn("incident", "rule", incident.Rule, "actions", strings.Join(incident.Actions, ","),
+			"errors", strings.Join(incident.Errors, "; "))
+	}
+
+	incidentMutex.Lock()
+	incidents = append(incidents, incident)
+
+	if len(incidents) > maxIncidents {
+		incidents = incidents[len(incidents)-maxIncidents:]
+	}
+	incidentMutex.Unlock()
+
+	select {
+	case WatchdogEvents <- incident:
+	default:
+		metrics.DroppedEvents.Inc("incident")
+	}
+}
+
+// resend sends the current play-order again, continuing at the current item and position.
+// without a play-order, the last persisted playback is restored
+func (updater *PlaybackStateUpdater) resend() error {
+	updater.stateMutex.RLock()
+	playlistIndex := updater.state.PlaylistIndex
+	order, entries := updater.playerIndices, updater.playerEntries
+	playerIndex, position := updater.state.OrderPosition, updater.state.MoviePosition
+	hasLast := updater.lastPlayback != nil
+	updater.stateMutex.RUnlock()
+
+	if len(order) == 0 {
+		if !hasLast {
+			return fmt.Errorf("no playback to resend")
+		}
+		updater.restore()
+		return nil
+	}
+	watchdogLogger.Info("resend playback", "item", playerIndex, "position", position)
+	updater.transmit(getPlaylist(playlistIndex), playlistIndex, order, entries, playerIndex, position, "")
+	return nil
+}
@@ -4,21 +4,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/command"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/playlist"
 )
 
+var logger = logging.New("sse")
+
 // A Server holds open client connections,
-// listens for incoming events on its ACKQueue and PlaybackQueue channels
+// listens for incoming events on its ACKQueue, PlaybackQueue, LibraryQueue, ThumbnailQueue and IncidentQueue channels
 // and broadcasts event data to all registered connections
 type Server struct {
 	ACKQueue chan *command.ACK
 
 	PlaybackQueue chan *playlist.PlaybackState
 
-	// Events are pushed to this channel by the main events-gathering routine
-	notifier chan []byte
+	LibraryQueue chan *playlist.LibraryChange
+
+	ThumbnailQueue chan *playlist.ThumbnailProgress
+
+	IncidentQueue chan *playlist.Incident
 
 	// New client connections
 	newClients chan chan []byte
@@ -28,6 +35,9 @@ type Server struct {
 
 	// Client connections registry
 	clients map[chan []byte]bool
+
+	// numClients mirrors len(clients) for other goroutines, the registry is owned by listen
+	numClients int32
 }
 
 // NewServer creates a new server instance
@@ -36,7 +46,9 @@ func NewServer() (server *Server) {
 	server = &Server{
 		ACKQueue:       make(chan *command.ACK, 100),
 		PlaybackQueue:  make(chan *playlist.PlaybackState, 100),
-		notifier:       make(chan []byte, 100),
+		LibraryQueue:   make(chan *playlist.LibraryChange, 100),
+		ThumbnailQueue: make(chan *playlist.ThumbnailProgress, 100),
+		IncidentQueue:  make(chan *playlist.Incident, 100),
 		newClients:     make(chan chan []byte),
 		closingClients: make(chan chan []byte),
 		clients:        make(map[chan []byte]bool),
@@ -49,7 +61,7 @@ func NewServer() (server *Server) {
 
 // NumClients returns the number of connected clients
 func (server *Server) NumClients() int {
-	return len(server.clients)
+	return int(atomic.LoadInt32(&server.numClients))
 }
 
 // Listen on different channels and act accordingly
@@ -61,19 +73,21 @@ func (server *Server) listen() {
 		case s := <-server.newClients:
 			// new client has connected, register their message channel
 			server.clients[s] = true
-			// log.Printf("Client added. %d registered clients", len(server.clients))
+			atomic.StoreInt32(&server.numClients, int32(len(server.clients)))
+			logger.Debug("client added", "clients", len(server.clients))
 
 		case s := <-server.closingClients:
 			// client has dettached, stop sending them messages.
 			delete(server.clients, s)
-			// log.Printf("Removed client. %d registered clients", len(server.clients))
+			atomic.StoreInt32(&server.numClients, int32(len(server.clients)))
+			logger.Debug("client removed", "clients", len(server.clients))
 
 		case ack := <-server.ACKQueue:
 			if jsonACK, err := json.Marshal(ack); err == nil {
 				sseBLob := fmt.Sprintf("event: commandACK\ndata: %s\n\n", jsonACK)
 
 				// send out CommandEvent
-				server.notifier <- []byte(sseBLob)
+				server.broadcast([]byte(sseBLob))
 			}
 
 		case playState := <-server.PlaybackQueue:
@@ -81,19 +95,44 @@ func (server *Server) listen() {
 				sseBLob := fmt.Sprintf("event: playstate\ndata: %s\n\n", jsonBlob)
 
 				// send out PlaybackState
-				server.notifier <- []byte(sseBLob)
+				server.broadcast([]byte(sseBLob))
+			}
+
+		case change := <-server.LibraryQueue:
+			if jsonBlob, err := json.Marshal(change); err == nil {
+				sseBLob := fmt.Sprintf("event: library\ndata: %s\n\n", jsonBlob)
+
+				// send out LibraryChange
+				server.broadcast([]byte(sseBLob))
 			}
 
-		case event := <-server.notifier:
+		case progress := <-server.ThumbnailQueue:
+			if jsonBlob, err := json.Marshal(progress); err == nil {
+				sseBLob := fmt.Sprintf("event: thumbnail\ndata: %s\n\n", jsonBlob)
 
-			// Send event to all connected clients
-			for clientMessageChan := range server.clients {
-				clientMessageChan <- event
+				// send out ThumbnailProgress
+				server.broadcast([]byte(sseBLob))
+			}
+
+		case incident := <-server.IncidentQueue:
+			if jsonBlob, err := json.Marshal(incident); err == nil {
+				sseBLob := fmt.Sprintf("event: incident\ndata: %s\n\n", jsonBlob)
+
+				// send out watchdog Incident
+				server.broadcast([]byte(sseBLob))
 			}
 		}
 	}
 }
 
+// broadcast sends an event to all connected clients.
+// only called by listen, which owns the registry
+func (server *Server) broadcast(event []byte) {
+	for clientMessageChan := range server.clients {
+		clientMessageChan <- event
+	}
+}
+
 func (server *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// make sure that the writer supports flushing.
 	flusher, ok := rw.(http.Flusher)
@@ -2,15 +2,25 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/command"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/logging"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/metrics"
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/notify"
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/playlist"
 	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/sse"
 	"github.com/fsnotify/fsnotify"
@@ -38,20 +48,62 @@ var queueWorker *command.QueueWorker
 // playback info and updater
 var playStateUpdater *playlist.PlaybackStateUpdater
 
-// media base directory
+// media base directory, used if no media-roots are configured
 var mediaDir = "/media/astrobase/Movies"
 
+// name of the media-root to watch, empty for all roots
+var watchRoot = ""
+
+// stops the running media-root watcher
+var watcherDone chan bool
+var watcherMutex sync.Mutex
+
+// background thumbnail generation
+var thumbnailPipeline *playlist.ThumbnailPipeline
+
+// number of concurrent thumbnail workers
+var numThumbnailWorkers = runtime.NumCPU() / 2
+
+// maximum size of uploaded thumbnail-images
+var maxThumbnailUpload int64 = 32 << 20
+
+// default page-size for movie-queries
+var defaultMoviesLimit = 100
+
 // interval to scan the movie-directory
 var autoSaveMinInterval = time.Second * 10
 
+// time without further events, before a changed path in the media-directory is processed
+var watchSettleInterval = time.Minute * 2
+
 var saveChan chan bool
 
+// loggers of the main subsystems
+var (
+	mainLogger    = logging.New("main")
+	httpLogger    = logging.New("http")
+	watcherLogger = logging.New("watcher")
+	commandLogger = logging.New("command")
+)
+
+// maxRequestIDLength limits request-IDs, provided by clients via the X-Request-ID header
+const maxRequestIDLength = 64
+
+// saveDuration records the time needed to save the playlist-state
+var saveDuration = metrics.NewHistogram("zug_save_duration_seconds",
+	"Time needed to save playlists and library.", "", metrics.LatencyBuckets)
+
 // GET
 func handlePlaylistsGET(w http.ResponseWriter, r *http.Request) {
 	// set content type
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	enc := json.NewEncoder(w)
-	enc.Encode(playlist.GetPlaylists())
+
+	// '?library=0' omits the movies of the "All ..." playlists, use '/movies' instead
+	if r.URL.Query().Get("library") == "0" {
+		playlist.EncodeJSON(w, playlist.GetPlaylistSummaries())
+		return
+	}
+	playlist.EncodeJSON(w, playlist.GetPlaylists())
 }
 
 // POST
@@ -70,8 +122,7 @@ func handlePlaylistsPOST(w http.ResponseWriter, r *http.Request) {
 	// signal that we need to save
 	trySave()
 
-	enc := json.NewEncoder(w)
-	enc.Encode(ps)
+	playlist.EncodeJSON(w, ps)
 }
 
 // POST
@@ -79,14 +130,23 @@ func handleRescanGET(w http.ResponseWriter, r *http.Request) {
 	// set content type
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	// rescan for media
-	playlist.GenerateThumbnails(mediaDir, serveFilesPath)
+	// select a single media-root or all of them
+	roots := playlist.SelectMediaRoots(r.URL.Query().Get("root"))
 
-	// init playlist module
-	playlist.Init(mediaDir)
+	if roots == nil {
+		http.Error(w, "unknown media-root", http.StatusNotFound)
+		return
+	}
+
+	// rescan for media, apply changes incrementally
+	change := playlist.Rescan(roots)
+
+	if !change.Empty() {
+		trySave()
+	}
 
 	enc := json.NewEncoder(w)
-	enc.Encode("scanning for new movies ...")
+	enc.Encode(change)
 }
 
 // GET
@@ -107,9 +167,10 @@ func handleCommand(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	decoder.Decode(command)
 
-	// insert struct-type and CommandID
+	// insert struct-type, CommandID and the request-ID to trace it
 	command.CommandID = int(atomic.AddInt32(&nextCommandID, 1))
-	log.Println("command:", command)
+	command.RequestID = logging.RequestID(r.Context())
+	httpLogger.Info("command", "cmd", command, "id", command.CommandID, "request_id", command.RequestID)
 	queueWorker.Commands <- command
 
 	// encode json ACK and send as response
@@ -128,7 +189,7 @@ func handlePlayback(w http.ResponseWriter, r *http.Request) {
 	decoder.Decode(newState)
 
 	// make it so!
-	go playStateUpdater.Playback(newState.MovieIndex, newState.PlaylistIndex)
+	go playStateUpdater.Playback(newState.MovieIndex, newState.PlaylistIndex, logging.RequestID(r.Context()))
 
 	// signal a change that we need to save
 	trySave()
@@ -139,16 +200,267 @@ func handlePlayback(w http.ResponseWriter, r *http.Request) {
 }
 
 // POST
-func handleMovieSettings(w http.ResponseWriter, r *http.Request) {
+func handleQueue(w http.ResponseWriter, r *http.Request) {
 	// set content type
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	// decode json-request
-	m := &playlist.Movie{}
+	request := struct {
+		Path string `json:"path"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "expected json with 'path'", http.StatusBadRequest)
+		return
+	}
+
+	// '/interrupt' plays the movie immediately, '/queue' after the current one
+	play := playStateUpdater.Enqueue
+
+	if strings.HasSuffix(r.URL.Path, "/interrupt") {
+		play = playStateUpdater.Interrupt
+	}
+
+	if err := play(request.Path, logging.RequestID(r.Context())); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.Encode(true)
+}
+
+// POST
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	playStateUpdater.Resume(logging.RequestID(r.Context()))
+
+	enc := json.NewEncoder(w)
+	enc.Encode(true)
+}
+
+// POST
+func handlePlayMode(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, an omitted mode resets to sequential playback
+	request := struct {
+		PlaylistIndex int                `json:"playlist_index"`
+		Mode          *playlist.PlayMode `json:"mode"`
+	}{}
 	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(m)
 
-	go playlist.UpdateMovieSettings(m)
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "expected json with 'playlist_index' and 'mode'", http.StatusBadRequest)
+		return
+	}
+
+	if err := playlist.SetPlayMode(request.PlaylistIndex, request.Mode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// signal a change that we need to save
+	trySave()
+
+	enc := json.NewEncoder(w)
+	enc.Encode(true)
+}
+
+// POST
+func handleTransition(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, an omitted transition resets to cuts
+	request := struct {
+		PlaylistIndex int                  `json:"playlist_index"`
+		Transition    *playlist.Transition `json:"transition"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "expected json with 'playlist_index' and 'transition'", http.StatusBadRequest)
+		return
+	}
+
+	if err := playlist.SetTransition(request.PlaylistIndex, request.Transition); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// signal a change that we need to save
+	trySave()
+
+	enc := json.NewEncoder(w)
+	enc.Encode(true)
+}
+
+// GET
+func handleMovieGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// '?refresh=1' forces a new metadata probe
+	path := r.URL.Query().Get("path")
+	force := r.URL.Query().Get("refresh") != ""
+	mov, err := playlist.ProbeMovie(path, force)
+
+	if mov == nil {
+		http.Error(w, "unknown movie", http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpLogger.Warn("could not probe movie", "path", path, "error", err,
+			"request_id", logging.RequestID(r.Context()))
+	} else if force {
+		trySave()
+	}
+
+	playlist.EncodeJSON(w, mov)
+}
+
+// GET
+func handleMoviesGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	query, err := parseMovieQuery(r.URL.Query())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	playlist.EncodeJSON(w, playlist.QueryMovies(query))
+}
+
+// parseMovieQuery reads a movie-query from url-parameters.
+// durations are in seconds, dates in RFC3339 or 'YYYY-MM-DD' format
+func parseMovieQuery(values url.Values) (playlist.MovieQuery, error) {
+	query := playlist.MovieQuery{
+		Text:  values.Get("q"),
+		Root:  values.Get("root"),
+		Type:  values.Get("type"),
+		Sort:  values.Get("sort"),
+		Limit: defaultMoviesLimit,
+	}
+	var err error
+
+	// tags are accepted as repeated parameters or comma-separated
+	for _, tags := range values["tag"] {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				query.Tags = append(query.Tags, tag)
+			}
+		}
+	}
+	floatParams := map[string]*float64{
+		"min_duration": &query.MinDuration,
+		"max_duration": &query.MaxDuration,
+	}
+
+	for name, value := range floatParams {
+		if v := values.Get(name); v != "" {
+			if *value, err = strconv.ParseFloat(v, 64); err != nil {
+				return query, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+	intParams := map[string]*int{
+		"min_width":  &query.MinWidth,
+		"min_height": &query.MinHeight,
+		"offset":     &query.Offset,
+		"limit":      &query.Limit,
+	}
+
+	for name, value := range intParams {
+		if v := values.Get(name); v != "" {
+			if *value, err = strconv.Atoi(v); err != nil || *value < 0 {
+				return query, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+	dateParams := map[string]*time.Time{
+		"added_after":  &query.AddedAfter,
+		"added_before": &query.AddedBefore,
+	}
+
+	for name, value := range dateParams {
+		if v := values.Get(name); v != "" {
+			if *value, err = time.Parse(time.RFC3339, v); err != nil {
+				if *value, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+					return query, fmt.Errorf("invalid %s: %s", name, v)
+				}
+			}
+		}
+	}
+
+	if v := values.Get("missing"); v != "" {
+		missing, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return query, fmt.Errorf("invalid missing: %s", v)
+		}
+		query.Missing = &missing
+	}
+	return query, nil
+}
+
+// POST
+func handleMovieMetadata(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, omitted fields are left unchanged
+	var meta playlist.MovieMetadata
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&meta); err != nil {
+		http.Error(w, "expected json with 'path' and optional 'title', 'tags', 'notes'", http.StatusBadRequest)
+		return
+	}
+	mov, err := playlist.UpdateMovieMetadata(meta)
+
+	if err != nil {
+		http.Error(w, "unknown movie", http.StatusNotFound)
+		return
+	}
+
+	// signal a change that we need to save
+	trySave()
+
+	playlist.EncodeJSON(w, mov)
+}
+
+// GET
+func handleTagsGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.Encode(playlist.GetTags())
+}
+
+// POST
+func handleMovieSettings(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, selecting the movie's defaults or a single playlist-entry
+	settings := &playlist.MovieSettings{}
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(settings); err != nil {
+		http.Error(w, "expected json with movie-settings", http.StatusBadRequest)
+		return
+	}
+
+	if err := playlist.UpdateMovieSettings(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// signal a change that we need to save
 	trySave()
@@ -158,59 +470,471 @@ func handleMovieSettings(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(true)
 }
 
+// GET
+func handleThumbnailsGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.Encode(thumbnailPipeline.Status())
+}
+
+// POST
+func handleThumbnailsCancel(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, an empty list of paths cancels all jobs
+	var paths []string
+	decoder := json.NewDecoder(r.Body)
+	decoder.Decode(&paths)
+
+	enc := json.NewEncoder(w)
+	enc.Encode(thumbnailPipeline.Cancel(paths))
+}
+
+// POST
+func handleThumbnailsPrioritize(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, holding the paths of all visible movies
+	var paths []string
+	decoder := json.NewDecoder(r.Body)
+	decoder.Decode(&paths)
+
+	thumbnailPipeline.Prioritize(paths, playlist.PriorityVisible)
+
+	enc := json.NewEncoder(w)
+	enc.Encode(true)
+}
+
+// POST
+func handleThumbnailsGC(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	removed, err := playlist.CollectThumbnailGarbage(serveFilesPath)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// encode removed files and send as response
+	enc := json.NewEncoder(w)
+	enc.Encode(removed)
+}
+
+// POST
+func handleThumbnailUpload(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// accept multipart-forms with an 'image' field or the raw image as body
+	path := r.URL.Query().Get("path")
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailUpload)
+	var data io.Reader = r.Body
+
+	if file, _, err := r.FormFile("image"); err == nil {
+		defer file.Close()
+		data = file
+	}
+	mov, err := playlist.SetCustomThumbnail(path, data, serveFilesPath)
+
+	if mov == nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// signal a change that we need to save
+	trySave()
+
+	playlist.EncodeJSON(w, mov)
+}
+
+// POST
+func handleThumbnailPoster(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, a missing time regenerates the default thumbnail
+	request := struct {
+		Path string   `json:"path"`
+		Time *float64 `json:"time"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&request); err != nil || request.Path == "" {
+		http.Error(w, "expected json with 'path' and optional 'time'", http.StatusBadRequest)
+		return
+	}
+	var mov *playlist.Movie
+	var err error
+
+	if request.Time != nil {
+		mov, err = playlist.SetPosterFrame(request.Path, *request.Time)
+	} else {
+		mov, err = playlist.RegenerateThumbnail(request.Path)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// signal a change that we need to save
+	trySave()
+
+	playlist.EncodeJSON(w, mov)
+}
+
+// GET
+func handleMediaRootsGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.Encode(playlist.GetMediaRoots())
+}
+
+// GET
+func handleOrphansGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	playlist.EncodeJSON(w, playlist.GetOrphans())
+}
+
+// POST
+func handleNotifyTest(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// deliver in parallel, reporting the result of every target or a timeout
+	enc := json.NewEncoder(w)
+	enc.Encode(notify.Test())
+}
+
+// GET, POST
+func handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// change the level of a single subsystem, or of all subsystems if omitted
+	if r.Method == "POST" {
+		request := struct {
+			Subsystem string `json:"subsystem"`
+			Level     string `json:"level"`
+		}{}
+		decoder := json.NewDecoder(r.Body)
+
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, "expected json with 'level' and optional 'subsystem'", http.StatusBadRequest)
+			return
+		}
+
+		if err := logging.SetLevel(request.Subsystem, request.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpLogger.Info("log-level changed", "subsystem", request.Subsystem, "level", request.Level,
+			"request_id", logging.RequestID(r.Context()))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.Encode(logging.Levels())
+}
+
+// GET
+func handleWatchdogGET(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	response := struct {
+		Settings  playlist.WatchdogSettings `json:"settings"`
+		Incidents []*playlist.Incident      `json:"incidents"`
+	}{playlist.GetWatchdogSettings(), playlist.GetIncidents()}
+
+	enc := json.NewEncoder(w)
+	enc.Encode(response)
+}
+
+// POST
+func handleOrphansPurge(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request, an empty list of paths purges all orphans
+	var paths []string
+	decoder := json.NewDecoder(r.Body)
+	decoder.Decode(&paths)
+
+	purged := playlist.PurgeOrphans(paths)
+
+	if len(purged) > 0 {
+		// signal a change that we need to save
+		trySave()
+	}
+
+	// encode purged paths and send as response
+	enc := json.NewEncoder(w)
+	enc.Encode(purged)
+}
+
+// POST
+func handleRelocate(w http.ResponseWriter, r *http.Request) {
+	// set content type
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// decode json-request
+	request := struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{}
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&request); err != nil || request.From == "" || request.To == "" {
+		http.Error(w, "expected json with 'from' and 'to' root-directories", http.StatusBadRequest)
+		return
+	}
+	relocated, err := playlist.RelocateRoot(request.From, request.To)
+
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// the relocated root needs to be watched at its new path
+	startWatcher()
+
+	if len(relocated) > 0 {
+		// signal a change that we need to save
+		trySave()
+	}
+
+	// encode relocated paths and send as response
+	enc := json.NewEncoder(w)
+	enc.Encode(relocated)
+}
+
+// GET
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	// '?proxy=1' prefers a lower-bitrate proxy, if available
+	path := r.URL.Query().Get("path")
+	proxy := r.URL.Query().Get("proxy") != ""
+	filePath, err := playlist.PreviewFile(path, proxy)
+
+	if err != nil {
+		http.Error(w, "unknown movie", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		http.Error(w, "could not open movie", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil || info.IsDir() {
+		http.Error(w, "could not open movie", http.StatusNotFound)
+		return
+	}
+
+	// handles Range-requests, so browsers can seek
+	http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), file)
+}
+
+// statusRecorder captures the status-code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
 // preflight OPTIONS
 func corsHandler(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// configure proper CORS
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+		// every request gets an ID, that follows resulting commands
+		requestID := r.Header.Get("X-Request-ID")
+
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		r = r.WithContext(logging.WithRequestID(r.Context(), requestID))
 
 		if r.Method != "OPTIONS" {
-			handler(w, r)
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			handler(rec, r)
+
+			// polled endpoints would flood the log, failed requests are always logged
+			logRequest := httpLogger.Debug
+
+			if rec.status >= http.StatusInternalServerError {
+				logRequest = httpLogger.Warn
+			}
+			logRequest("request", "method", r.Method, "path", r.URL.Path, "status", rec.status,
+				"duration", time.Since(start), "request_id", requestID)
 		}
 	}
 }
 
 func commandQueueCollector(results <-chan *command.ACK) {
 	for ack := range results {
+		commandLogger.Debug("ack", "cmd", ack.Command, "success", ack.Success,
+			"request_id", ack.RequestID)
 
 		// send ack via SSE
 		sseServer.ACKQueue <- ack
 	}
 }
 
-func watchMediaDirectory(mediaDir string, doneChan chan bool) {
+// startWatcher (re-)starts watching the selected media-roots, e.g. after a media-root was relocated
+func startWatcher() {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
 
-	log.Println("watching media-directory:", mediaDir)
+	if watcherDone != nil {
+		close(watcherDone)
+		watcherDone = nil
+	}
+
+	if roots := playlist.SelectMediaRoots(watchRoot); roots != nil {
+		watcherDone = make(chan bool)
+		go watchMediaRoots(roots, watcherDone)
+	} else {
+		watcherLogger.Warn("unknown media-root to watch", "root", watchRoot)
+	}
+}
+
+func watchMediaRoots(roots []*playlist.MediaRoot, doneChan chan bool) {
 
 	// creates a new file watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		fmt.Println("ERROR", err)
+		watcherLogger.Error("could not create watcher", "error", err)
+		return
 	}
 	defer watcher.Close()
 
-	// watch our mediaDir
-	if err := watcher.Add(mediaDir); err != nil {
-		fmt.Println("ERROR", err)
+	// watch our media-roots, including sub-directories of recursive roots
+	for _, root := range roots {
+		watcherLogger.Info("watching media-directory", "path", root.Path, "recursive", root.Recursive)
+
+		if root.Recursive {
+			addWatchRecursive(watcher, root.Path)
+		} else if err := watcher.Add(root.Path); err != nil {
+			watcherLogger.Error("could not watch directory", "path", root.Path, "error", err)
+		}
 	}
+
+	// changed paths, mapped to the time of their latest event
+	pending := make(map[string]time.Time)
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case event := <-watcher.Events:
 			// watch for events
-			log.Printf("event in directory: %#v\n", event)
-			log.Println("waiting 2 minutes for things to calm down ...")
-			time.Sleep(time.Minute * 2)
-			playlist.GenerateThumbnails(mediaDir, serveFilesPath)
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			watcherLogger.Debug("event in directory", "path", event.Name, "op", event.Op)
+
+			// new sub-directories of recursive roots need to be watched as well
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				for _, root := range roots {
+					if root.Recursive && root.Contains(event.Name) {
+						addWatchRecursive(watcher, event.Name)
+						break
+					}
+				}
+			}
+			pending[event.Name] = time.Now()
+
+		case <-ticker.C:
+			// collect paths that had time to calm down
+			var settled []string
+
+			for path, lastEvent := range pending {
+				if time.Since(lastEvent) > watchSettleInterval {
+					settled = append(settled, path)
+					delete(pending, path)
+				}
+			}
+
+			if len(settled) > 0 {
+				if change := playlist.UpdateLibrary(settled); !change.Empty() {
+					trySave()
+				}
+			}
 
 		case err := <-watcher.Errors:
 			// watch for errors
-			fmt.Println("ERROR", err)
+			watcherLogger.Error("watcher failed", "error", err)
+
+		case <-doneChan:
+			return
 		}
 	}
 }
 
+// addWatchRecursive adds the provided directory and all its sub-directories to a watcher
+func addWatchRecursive(watcher *fsnotify.Watcher, dir string) {
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err == nil && f.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				watcherLogger.Error("could not watch directory", "path", path, "error", err)
+			}
+		}
+		return nil
+	})
+}
+
+// registerMetrics adds gauges for the state of player, queues, event-stream and library
+func registerMetrics() {
+	metrics.NewGaugeFunc("zug_player_connected", "1 if the player is reachable.", func() float64 {
+		if playStateUpdater != nil && playStateUpdater.GetState().Connected {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGaugeFunc("zug_command_queue_length", "Commands waiting to be sent to the player.", func() float64 {
+		return float64(len(queueWorker.Commands))
+	})
+	metrics.NewGaugeFunc("zug_ack_queue_length", "ACKs waiting to be collected.", func() float64 {
+		return float64(len(queueWorker.Results))
+	})
+	metrics.NewGaugeFunc("zug_sse_clients", "Connected event-stream clients.", func() float64 {
+		return float64(sseServer.NumClients())
+	})
+	metrics.NewGaugeFunc("zug_library_movies", "Movies in the library.", func() float64 {
+		total, _ := playlist.NumMovies()
+		return float64(total)
+	})
+	metrics.NewGaugeFunc("zug_library_missing_movies", "Movies of the library missing on disk.", func() float64 {
+		_, missing := playlist.NumMovies()
+		return float64(missing)
+	})
+}
+
 func trySave() {
 	select {
 	case saveChan <- true:
@@ -223,10 +947,10 @@ func saveDeBounced(timeOut time.Duration) {
 		// will block eventually
 		<-saveChan
 
-		// log.Println("saveDeBounced: ok")
-
 		// save playlist state
+		start := time.Now()
 		playlist.Save(mediaDir)
+		saveDuration.Observe("", time.Since(start).Seconds())
 
 		// save settings in mediaplayer
 		command := &command.Command{Command: "save_settings"}
@@ -237,7 +961,9 @@ func saveDeBounced(timeOut time.Duration) {
 }
 
 func main() {
-	log.Println("welcome", os.Args[0])
+	// leveled logging, levels can be changed at runtime via '/log/levels'
+	logging.LoadSettings()
+	mainLogger.Info("welcome", "binary", os.Args[0])
 
 	// get serve path
 	if len(os.Args) > 1 {
@@ -261,6 +987,26 @@ func main() {
 		playerAddress = os.Args[4]
 	}
 
+	// get name of the media-root to watch
+	if len(os.Args) > 5 {
+		watchRoot = os.Args[5]
+	}
+
+	// configured media-types and media-roots, fallback to mediaDir
+	playlist.LoadMediaTypes()
+	playlist.LoadThumbnailSettings()
+	playlist.LoadPreviewSettings()
+	playlist.LoadPlaybackSettings()
+	playlist.LoadWatchdogSettings()
+	notify.LoadSettings()
+
+	// alert delivery, watching the free space for thumbnails in addition to the configured paths
+	notify.Start(serveFilesPath)
+	playlist.LoadMediaRoots(mediaDir)
+
+	// random play-orders
+	rand.Seed(time.Now().UnixNano())
+
 	saveChan = make(chan bool, 2)
 
 	// start command processing
@@ -273,12 +1019,22 @@ func main() {
 	// serves eventstream
 	sseServer = sse.NewServer()
 
+	// broadcast library changes and thumbnail progress
+	playlist.LibraryEvents = sseServer.LibraryQueue
+	playlist.ThumbnailEvents = sseServer.ThumbnailQueue
+	playlist.PlaybackACKs = queueWorker.Results
+	playlist.WatchdogEvents = sseServer.IncidentQueue
+
 	// create a gorilla mux-router
 	muxRouter := mux.NewRouter()
 
 	// http services
 	muxRouter.Handle("/events", sseServer)
 
+	// prometheus metrics
+	registerMetrics()
+	muxRouter.HandleFunc("/metrics", metrics.Handler).Methods("GET")
+
 	// get/set playlist information
 	muxRouter.HandleFunc("/playlists", corsHandler(handlePlaylistsGET)).Methods("GET", "OPTIONS")
 	muxRouter.HandleFunc("/playlists", corsHandler(handlePlaylistsPOST)).Methods("POST", "OPTIONS")
@@ -288,31 +1044,94 @@ func main() {
 
 	muxRouter.HandleFunc("/playstate", corsHandler(handlePlayStateGET)).Methods("GET", "OPTIONS")
 
-	// set the delay for a single movie
+	// set the play-mode of a playlist, applied with its next playback
+	muxRouter.HandleFunc("/playmode", corsHandler(handlePlayMode)).Methods("POST", "OPTIONS")
+
+	// play a movie after the current one, or interrupt playback and resume afterwards
+	muxRouter.HandleFunc("/queue", corsHandler(handleQueue)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/interrupt", corsHandler(handleQueue)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/interrupt/resume", corsHandler(handleResume)).Methods("POST", "OPTIONS")
+
+	// set the default transition between the items of a playlist, applied with its next playback
+	muxRouter.HandleFunc("/transition", corsHandler(handleTransition)).Methods("POST", "OPTIONS")
+
+	// set the defaults of a movie or the settings of a single playlist-entry
 	muxRouter.HandleFunc("/movie", corsHandler(handleMovieSettings)).Methods("POST", "OPTIONS")
 
+	// get a single movie, including its metadata, via '?path=<path>'
+	muxRouter.HandleFunc("/movie", corsHandler(handleMovieGET)).Methods("GET", "OPTIONS")
+
+	// search and filter the library, edit title, tags and notes of a single movie
+	muxRouter.HandleFunc("/movies", corsHandler(handleMoviesGET)).Methods("GET", "OPTIONS")
+	muxRouter.HandleFunc("/movie/meta", corsHandler(handleMovieMetadata)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/tags", corsHandler(handleTagsGET)).Methods("GET", "OPTIONS")
+
+	// rescan all media-roots or a single one, selected via '?root=<name>'
 	muxRouter.HandleFunc("/rescan", corsHandler(handleRescanGET)).Methods("GET", "OPTIONS")
+	muxRouter.HandleFunc("/roots", corsHandler(handleMediaRootsGET)).Methods("GET", "OPTIONS")
+
+	// status and control of background thumbnail generation
+	muxRouter.HandleFunc("/thumbnails", corsHandler(handleThumbnailsGET)).Methods("GET", "OPTIONS")
+	muxRouter.HandleFunc("/thumbnails/cancel", corsHandler(handleThumbnailsCancel)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/thumbnails/prioritize", corsHandler(handleThumbnailsPrioritize)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/thumbnails/gc", corsHandler(handleThumbnailsGC)).Methods("POST", "OPTIONS")
+
+	// custom thumbnails, poster-frames and regeneration for a single movie
+	muxRouter.HandleFunc("/thumbnail/upload", corsHandler(handleThumbnailUpload)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/thumbnail/poster", corsHandler(handleThumbnailPoster)).Methods("POST", "OPTIONS")
+	muxRouter.HandleFunc("/thumbnail/regenerate", corsHandler(handleThumbnailPoster)).Methods("POST", "OPTIONS")
+
+	// stream a movie or its proxy for previews, via '?path=<path>&proxy=1'
+	muxRouter.HandleFunc("/preview", corsHandler(handlePreview)).Methods("GET", "HEAD", "OPTIONS")
+
+	// list and purge movies that went missing on disk
+	muxRouter.HandleFunc("/orphans", corsHandler(handleOrphansGET)).Methods("GET", "OPTIONS")
+	muxRouter.HandleFunc("/orphans/purge", corsHandler(handleOrphansPurge)).Methods("POST", "OPTIONS")
+
+	// watchdog-rules and recent incidents
+	muxRouter.HandleFunc("/watchdog", corsHandler(handleWatchdogGET)).Methods("GET", "OPTIONS")
+
+	// get/set log-levels per subsystem
+	muxRouter.HandleFunc("/log/levels", corsHandler(handleLogLevels)).Methods("GET", "POST", "OPTIONS")
+
+	// send a test-notification to all configured webhooks and smtp
+	muxRouter.HandleFunc("/notify/test", corsHandler(handleNotifyTest)).Methods("POST", "OPTIONS")
+
+	// move a media-root and its movie-paths after the media mount-point changed
+	muxRouter.HandleFunc("/relocate", corsHandler(handleRelocate)).Methods("POST", "OPTIONS")
 
 	muxRouter.HandleFunc("/cmd", corsHandler(handleCommand)).Methods("POST", "OPTIONS")
 	muxRouter.PathPrefix("/").Handler(fs)
 	http.Handle("/", muxRouter)
 
+	// background thumbnail generation
+	thumbnailPipeline = playlist.StartThumbnailPipeline(serveFilesPath, numThumbnailWorkers)
+
 	// init playlist module
-	playlist.Init(mediaDir)
+	playlist.Init()
+
+	// switch to collision-free thumbnail names, remove unused files
+	if playlist.MigrateThumbnails(serveFilesPath) > 0 {
+		trySave()
+	}
+	playlist.CollectThumbnailGarbage(serveFilesPath)
+	playlist.CollectPreviewGarbage()
+
+	// initial thumb generation in background
+	playlist.GenerateThumbnails()
 
-	// initial thumb generation + (re-)init playlist module
-	playlist.GenerateThumbnails(mediaDir, serveFilesPath)
+	// optional lower-bitrate proxies for previews
+	playlist.StartPreviewGeneration()
 
 	// kick off periodic playbackstate updates
 	playStateUpdater = playlist.NewPlaybackStateUpdater(playerAddress, time.Second, sseServer.PlaybackQueue)
 
-	// watch for changes in directory
-	go watchMediaDirectory(mediaDir, nil)
+	// watch for changes in media-roots
+	startWatcher()
 
 	// debounced save-settings routine
 	go saveDeBounced(autoSaveMinInterval)
 
-	log.Println("server listening on port", listenPort, " -- serving files from", serveFilesPath)
-	log.Println("media_player @", playerAddress)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", listenPort), nil))
+	mainLogger.Info("server listening", "port", listenPort, "files", serveFilesPath, "player", playerAddress)
+	mainLogger.Fatal("server failed", "error", http.ListenAndServe(fmt.Sprintf(":%d", listenPort), nil))
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crocdialer/zug_ins_nirgendwo_backend_v2/playlist"
+)
+
+// TestHandlersRace requests movies and playlists from the http-handlers,
+// while the thumbnail-pipeline indexes and thumbnails the library. run with -race
+func TestHandlersRace(t *testing.T) {
+	dir := t.TempDir()
+
+	// settings- and state-files are relative to the working directory
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// no external tools
+	playlist.FFProbePath = filepath.Join(dir, "ffprobe")
+	playlist.FFMpegPath = filepath.Join(dir, "ffmpeg")
+
+	media := filepath.Join(dir, "media")
+	var paths []string
+
+	writeMovies := func(from, to int) {
+		for i := from; i < to; i++ {
+			p := filepath.Join(media, fmt.Sprintf("movie%02d.mp4", i))
+
+			if err := os.WriteFile(p, []byte(fmt.Sprintf("not a movie %d", i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, p)
+		}
+	}
+
+	if err := os.MkdirAll(media, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	writeMovies(0, 8)
+
+	playlist.LoadMediaRoots(media)
+	playlist.Init()
+	thumbnailPipeline = playlist.StartThumbnailPipeline(filepath.Join(dir, "public"), 4)
+
+	requests := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{handlePlaylistsGET, "GET", "/playlists", ""},
+		{handlePlaylistsGET, "GET", "/playlists?library=0", ""},
+		{handleMoviesGET, "GET", "/movies", ""},
+		{handleMovieGET, "GET", "/movie?path=" + url.QueryEscape(paths[0]), ""},
+		{handleOrphansGET, "GET", "/orphans", ""},
+		{handleMovieMetadata, "POST", "/movie/metadata", fmt.Sprintf(`{"path": %q, "title": "title"}`, paths[1])},
+	}
+	done := make(chan bool)
+	requested := make(chan bool)
+
+	go func() {
+		defer close(requested)
+
+		for {
+			for _, request := range requests {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				request.handler(rec, httptest.NewRequest(request.method, request.target,
+					strings.NewReader(request.body)))
+
+				if rec.Code != http.StatusOK {
+					t.Errorf("%s %s: status %d", request.method, request.target, rec.Code)
+				}
+			}
+		}
+	}()
+
+	// new movies are indexed, the others get their thumbnails
+	writeMovies(8, 16)
+	playlist.Rescan(playlist.SelectMediaRoots(""))
+	playlist.GenerateThumbnails()
+	deadline := time.Now().Add(30 * time.Second)
+
+	for {
+		status := thumbnailPipeline.Status()
+
+		if status.Queued == 0 && status.Running == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline not idle: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-requested
+}